@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ankiColumns are fields of notes in exported deck
+var ankiColumns = []string{"Word", "Audio", "Author", "Country", "Sex"}
+
+// exportAnkiFlags adds options of `export anki` command
+func exportAnkiFlags(fs *flag.FlagSet) {
+	config["ANKI_COUNTRY"] = ""
+	fs.Func("country", "prefer pronunciations of speakers from `country`. Default the best rated one",
+		func(s string) error {
+			config["ANKI_COUNTRY"] = s
+			return nil
+		})
+}
+
+// exportAnki saves pronunciations of words into a media directory and writes
+// a CSV file ready for Anki import. Media directory is named after the CSV
+// file: deck.csv -> deck.media.
+func exportAnki(cfg Config, args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "deck file name is missing")
+		os.Exit(1)
+	}
+	deck := args[0]
+	if filepath.Ext(deck) != ".csv" {
+		fmt.Fprintln(os.Stderr, "deck file has to be .csv")
+		os.Exit(1)
+	}
+	words := readWords(cfg, args[1:])
+	if len(words) == 0 {
+		fmt.Fprintln(os.Stderr, "no words to export")
+		os.Exit(1)
+	}
+
+	media := strings.TrimSuffix(deck, ".csv") + ".media"
+	if err := os.MkdirAll(media, 0750); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	cfg["DOWNLOAD"] = "yes"
+
+	var notes [][]string
+	for i, word := range words {
+		list := getPronList(cfg, word)
+		if len(list) == 0 {
+			continue
+		}
+		item := choosePron(list, cfg["ANKI_COUNTRY"])
+		// media of all decks share one Anki folder, so names have to be unique
+		name := "tellme_" + cfg["LANG"] + "_" + item.aFile
+		item.aFile = filepath.Join(media, name)
+		if path, err := saveWord(cfg, item); err != nil || path != item.aFile {
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			fmt.Fprintf(os.Stderr, "can not save audio for '%s'\n", word)
+			continue
+		}
+		notes = append(notes, []string{word, "[sound:" + name + "]",
+			item.author, item.country, item.sex})
+		fmt.Printf("[%d/%d] %s: %s\n", i+1, len(words), word, item.fullAuthor)
+	}
+	if len(notes) == 0 {
+		fmt.Fprintln(os.Stderr, "no pronunciations to export")
+		os.Exit(1)
+	}
+
+	if err := writeAnkiCSV(cfg, deck, notes); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Exported %d of %d words to %s. Copy files from %s into "+
+		"collection.media folder of your Anki profile.\n",
+		len(notes), len(words), deck, media)
+}
+
+// choosePron returns the first pronunciation by a speaker from country or
+// the first one if there is no such speaker
+func choosePron(list []Pron, country string) Pron {
+	for _, item := range list {
+		if country != "" && strings.EqualFold(item.country, country) {
+			return item
+		}
+	}
+	return list[0]
+}
+
+// writeAnkiCSV writes notes in CSV format with Anki file headers
+func writeAnkiCSV(cfg Config, path string, notes [][]string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(f, "#separator:comma")
+	fmt.Fprintln(f, "#html:true")
+	fmt.Fprintf(f, "#columns:%s\n", strings.Join(ankiColumns, ","))
+	fmt.Fprintf(f, "#tags:tellme %s\n", cfg["LANG"])
+	w := csv.NewWriter(f)
+	for _, note := range notes {
+		w.Write(note)
+	}
+	w.Flush()
+	if err = w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
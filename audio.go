@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hajimehoshi/go-mp3"
+	"github.com/jfreymuth/oggvorbis"
+)
+
+// pcm is decoded audio: interleaved samples in range [-1, 1]
+type pcm struct {
+	rate     int
+	channels int
+	samples  []float32
+}
+
+// decodeAudio decodes mp3, ogg/vorbis or wav file to pcm
+func decodeAudio(path string) (*pcm, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".mp3":
+		return decodeMp3(f)
+	case ".ogg":
+		return decodeOgg(f)
+	case ".wav":
+		return decodeWav(f)
+	}
+	return nil, fmt.Errorf("can not decode %s: unknown audio format", path)
+}
+
+// decodable checks if decodeAudio can read the format (file extension
+// without dot)
+func decodable(format string) bool {
+	switch format {
+	case "mp3", "ogg", "wav":
+		return true
+	}
+	return false
+}
+
+// decodeMp3 decodes mp3 stream. The decoder always returns 16 bit stereo.
+func decodeMp3(r io.Reader) (*pcm, error) {
+	dec, err := mp3.NewDecoder(r)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(dec)
+	if err != nil {
+		return nil, err
+	}
+
+	audio := &pcm{
+		rate:     dec.SampleRate(),
+		channels: 2,
+		samples:  make([]float32, len(data)/2),
+	}
+	for i := range audio.samples {
+		v := int16(binary.LittleEndian.Uint16(data[i*2:]))
+		audio.samples[i] = float32(v) / 32768
+	}
+	return audio, nil
+}
+
+// decodeOgg decodes ogg/vorbis stream
+func decodeOgg(r io.Reader) (*pcm, error) {
+	dec, err := oggvorbis.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	audio := &pcm{
+		rate:     dec.SampleRate(),
+		channels: dec.Channels(),
+	}
+	buf := make([]float32, 4096*dec.Channels())
+	for {
+		n, err := dec.Read(buf)
+		audio.samples = append(audio.samples, buf[:n]...)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return audio, nil
+}
+
+// frames returns number of samples per channel
+func (p *pcm) frames() int {
+	if p.channels == 0 {
+		return 0
+	}
+	return len(p.samples) / p.channels
+}
+
+// duration returns length of audio
+func (p *pcm) duration() time.Duration {
+	if p.rate == 0 {
+		return 0
+	}
+	return time.Duration(p.frames()) * time.Second / time.Duration(p.rate)
+}
+
+// stretch changes tempo of audio by speed factor keeping its pitch. It uses
+// WSOLA: frames of input are overlap-added with a fixed output hop and every
+// next frame is shifted a bit to match the waveform of the previous one.
+func (p *pcm) stretch(speed float64) *pcm {
+	if speed == 1 || speed <= 0 || p.frames() == 0 {
+		return p
+	}
+
+	frameLen := p.rate * 40 / 1000
+	hop := frameLen / 2
+	tolerance := p.rate * 10 / 1000
+	inFrames := p.frames()
+	ch := p.channels
+
+	window := make([]float32, frameLen)
+	for i := range window {
+		window[i] = float32(0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(frameLen)))
+	}
+
+	// mono mix is used to search for the best overlap position
+	mono := make([]float32, inFrames)
+	for i := 0; i < inFrames; i++ {
+		for c := 0; c < ch; c++ {
+			mono[i] += p.samples[i*ch+c]
+		}
+	}
+
+	outFrames := int(float64(inFrames)/speed) + frameLen
+	out := &pcm{
+		rate:     p.rate,
+		channels: ch,
+		samples:  make([]float32, outFrames*ch),
+	}
+
+	prevPos, end := 0, 0
+	for k := 0; ; k++ {
+		outPos := k * hop
+		nominal := int(float64(k*hop) * speed)
+		if nominal+frameLen+tolerance >= inFrames || outPos+frameLen >= outFrames {
+			break
+		}
+
+		pos := nominal
+		if k > 0 {
+			// natural continuation of the previous frame
+			natural := prevPos + hop
+			best := math.Inf(-1)
+			for d := -tolerance; d <= tolerance; d++ {
+				cand := nominal + d
+				if cand < 0 {
+					continue
+				}
+				var corr float64
+				for i := 0; i < hop; i += 2 {
+					corr += float64(mono[natural+i] * mono[cand+i])
+				}
+				if corr > best {
+					best = corr
+					pos = cand
+				}
+			}
+		}
+
+		for i := 0; i < frameLen; i++ {
+			for c := 0; c < ch; c++ {
+				out.samples[(outPos+i)*ch+c] += p.samples[(pos+i)*ch+c] * window[i]
+			}
+		}
+		prevPos = pos
+		end = outPos + frameLen
+	}
+	out.samples = out.samples[:end*ch]
+	return out
+}
+
+// resample converts audio to another sample rate using linear interpolation
+func (p *pcm) resample(rate int) *pcm {
+	if rate == p.rate || p.frames() == 0 {
+		return p
+	}
+	frames := int(int64(p.frames()) * int64(rate) / int64(p.rate))
+	result := &pcm{rate: rate, channels: p.channels,
+		samples: make([]float32, frames*p.channels)}
+	ratio := float64(p.rate) / float64(rate)
+	for i := 0; i < frames; i++ {
+		pos := float64(i) * ratio
+		j := int(pos)
+		frac := float32(pos - float64(j))
+		next := j + 1
+		if next >= p.frames() {
+			next = p.frames() - 1
+		}
+		for c := 0; c < p.channels; c++ {
+			a := p.samples[j*p.channels+c]
+			b := p.samples[next*p.channels+c]
+			result.samples[i*p.channels+c] = a + (b-a)*frac
+		}
+	}
+	return result
+}
+
+// remix converts audio to another number of channels. Channels are averaged
+// when converting to mono and copied otherwise.
+func (p *pcm) remix(channels int) *pcm {
+	if channels == p.channels {
+		return p
+	}
+	result := &pcm{rate: p.rate, channels: channels,
+		samples: make([]float32, p.frames()*channels)}
+	for i := 0; i < p.frames(); i++ {
+		frame := p.samples[i*p.channels : (i+1)*p.channels]
+		if channels == 1 {
+			var sum float32
+			for _, v := range frame {
+				sum += v
+			}
+			result.samples[i] = sum / float32(p.channels)
+			continue
+		}
+		for c := 0; c < channels; c++ {
+			result.samples[i*channels+c] = frame[c%p.channels]
+		}
+	}
+	return result
+}
+
+// decodeWav decodes RIFF/WAVE stream with 16 bit integer or 32 bit float
+// samples
+func decodeWav(r io.Reader) (*pcm, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		return nil, errors.New("not a wav file")
+	}
+
+	var format, bits int
+	audio := &pcm{}
+	for pos := 12; pos+8 <= len(data); {
+		id := string(data[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		body := data[pos+8:]
+		if size > len(body) {
+			size = len(body)
+		}
+		body = body[:size]
+
+		switch id {
+		case "fmt ":
+			if size < 16 {
+				return nil, errors.New("broken wav format chunk")
+			}
+			format = int(binary.LittleEndian.Uint16(body[0:]))
+			audio.channels = int(binary.LittleEndian.Uint16(body[2:]))
+			audio.rate = int(binary.LittleEndian.Uint32(body[4:]))
+			bits = int(binary.LittleEndian.Uint16(body[14:]))
+		case "data":
+			switch {
+			case format == 1 && bits == 16:
+				audio.samples = make([]float32, size/2)
+				for i := range audio.samples {
+					v := int16(binary.LittleEndian.Uint16(body[i*2:]))
+					audio.samples[i] = float32(v) / 32768
+				}
+			case format == 3 && bits == 32:
+				audio.samples = make([]float32, size/4)
+				for i := range audio.samples {
+					audio.samples[i] = math.Float32frombits(
+						binary.LittleEndian.Uint32(body[i*4:]))
+				}
+			default:
+				return nil, fmt.Errorf("unsupported wav format %d with %d bits",
+					format, bits)
+			}
+			return audio, nil
+		}
+		// chunks are padded to even size
+		pos += 8 + size + size%2
+	}
+	return nil, errors.New("no audio data in wav file")
+}
+
+// encodeWav writes audio as 16 bit RIFF/WAVE stream
+func encodeWav(w io.Writer, audio *pcm) error {
+	dataSize := len(audio.samples) * 2
+	header := make([]byte, 44)
+	copy(header[0:], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], uint32(36+dataSize))
+	copy(header[8:], "WAVE")
+	copy(header[12:], "fmt ")
+	binary.LittleEndian.PutUint32(header[16:], 16)
+	binary.LittleEndian.PutUint16(header[20:], 1)
+	binary.LittleEndian.PutUint16(header[22:], uint16(audio.channels))
+	binary.LittleEndian.PutUint32(header[24:], uint32(audio.rate))
+	binary.LittleEndian.PutUint32(header[28:], uint32(audio.rate*audio.channels*2))
+	binary.LittleEndian.PutUint16(header[32:], uint16(audio.channels*2))
+	binary.LittleEndian.PutUint16(header[34:], 16)
+	copy(header[36:], "data")
+	binary.LittleEndian.PutUint32(header[40:], uint32(dataSize))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	data := make([]byte, dataSize)
+	for i, v := range audio.samples {
+		v = float32(math.Max(-1, math.Min(1, float64(v))))
+		binary.LittleEndian.PutUint16(data[i*2:], uint16(int16(v*32767)))
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// writeWav saves audio to a wav file
+func writeWav(path string, audio *pcm) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err = encodeWav(f, audio); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
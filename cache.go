@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Cache layout:
+//
+//	CACHE_DIR/audio/<atype>/<hh>/<audio id>.<atype>  audio files
+//	CACHE_DIR/index/<lang>/<hh>/<word>.json          word -> pronunciations
+//
+// Audio files are keyed by the stable audio identifier of the source, so the
+// same recording is stored only once and does not depend on the author's
+// display name. The index keeps all metadata needed to rebuild the
+// pronunciation list without going to the network.
+const cacheAudioDir = "audio"
+const cacheIndexDir = "index"
+
+type cacheEntry struct {
+	ID      string `json:"id"`
+	Author  string `json:"author"`
+	Sex     string `json:"sex"`
+	Country string `json:"country"`
+}
+
+type cacheIndex struct {
+	Word    string       `json:"word"`
+	Lang    string       `json:"lang"`
+	Updated time.Time    `json:"updated"`
+	Entries []cacheEntry `json:"entries"`
+}
+
+// hashBucket returns a short prefix of md5 sum used to split cache files
+// between subdirectories
+func hashBucket(s string) string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(s)))[0:2]
+}
+
+// audioCachePath returns cache directory and cache file for audio with id
+// in atype format
+func audioCachePath(cfg Config, atype, id string) (string, string) {
+	dir := filepath.Join(cfg["CACHE_DIR"], cacheAudioDir, atype, hashBucket(id))
+	file := filepath.Join(dir, url.PathEscape(id)+"."+atype)
+	return dir, file
+}
+
+// indexPath returns path of the index file for a word in a language. The word
+// is escaped, so slashes in it can not lead out of the cache directory.
+func indexPath(cfg Config, lang, word string) string {
+	return filepath.Join(cfg["CACHE_DIR"], cacheIndexDir, lang,
+		hashBucket(word), url.PathEscape(word)+".json")
+}
+
+// legacyCacheFile returns the path a pronunciation had in the old cache
+// layout, where files were named after the word and the author
+func legacyCacheFile(cfg Config, item Pron) string {
+	return filepath.Join(cfg["CACHE_DIR"], cfg["ATYPE"], cfg["LANG"],
+		hashBucket(item.word), item.word+"_"+item.author+"."+cfg["ATYPE"])
+}
+
+// writeIndex saves metadata of the pronunciation list of a word in cache
+func writeIndex(cfg Config, word string, list []Pron) error {
+	idx := cacheIndex{
+		Word:    word,
+		Lang:    cfg["LANG"],
+		Updated: time.Now().UTC(),
+	}
+	for _, item := range list {
+		idx.Entries = append(idx.Entries, cacheEntry{
+			ID:      item.id,
+			Author:  item.author,
+			Sex:     item.sex,
+			Country: item.country,
+		})
+	}
+
+	data, err := json.MarshalIndent(idx, "", "  ")
+	if err != nil {
+		return err
+	}
+	file := indexPath(cfg, idx.Lang, word)
+	if err = os.MkdirAll(filepath.Dir(file), 0750); err != nil {
+		return err
+	}
+	return os.WriteFile(file, data, 0640)
+}
+
+// readIndex reads cached metadata for a word in a language
+func readIndex(cfg Config, lang, word string) (cacheIndex, error) {
+	var idx cacheIndex
+	data, err := os.ReadFile(indexPath(cfg, lang, word))
+	if err != nil {
+		return idx, err
+	}
+	err = json.Unmarshal(data, &idx)
+	return idx, err
+}
+
+// cachedPronList rebuilds the pronunciation list of a word from the cache
+// index. Returns nil if the word is not in the index or the index entry is
+// older than cfg["INDEX_MAX_AGE"] days.
+func cachedPronList(cfg Config, word string) (result []Pron) {
+	idx, err := readIndex(cfg, cfg["LANG"], word)
+	if err != nil {
+		return
+	}
+	maxAge, _ := strconv.Atoi(cfg["INDEX_MAX_AGE"])
+	if maxAge > 0 && time.Since(idx.Updated) > time.Duration(maxAge)*24*time.Hour {
+		return
+	}
+	for _, e := range idx.Entries {
+		result = append(result, newPron(cfg, word, e.ID, e.Author, e.Sex,
+			e.Country))
+	}
+	return
+}
+
+// migrateLegacyFile moves an audio file from the old word_author layout to
+// its content-addressed place. Returns true if the file was migrated.
+func migrateLegacyFile(cfg Config, item Pron) bool {
+	legacy := legacyCacheFile(cfg, item)
+	if _, err := os.Stat(legacy); err != nil {
+		return false
+	}
+	if cfg["VERBOSE"] == "yes" {
+		fmt.Printf("Migrate cache file: `%s`\n", legacy)
+	}
+	if err := os.MkdirAll(item.cacheDir, 0750); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return false
+	}
+	if err := os.Rename(legacy, item.cacheFile); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return false
+	}
+	// remove the old bucket directory if it is empty now
+	os.Remove(filepath.Dir(legacy))
+	return true
+}
+
+// cacheAudio makes sure the audio file of a pronunciation is in cache and
+// returns its path
+func cacheAudio(cfg Config, item Pron) (string, error) {
+	_, err := os.Stat(item.cacheFile)
+	if errors.Is(err, os.ErrNotExist) && !migrateLegacyFile(cfg, item) {
+		err = getAudio(cfg, item.aURL, item.cacheFile)
+		if err != nil {
+			os.Remove(item.cacheFile)
+			return "", err
+		}
+	}
+	return item.cacheFile, nil
+}
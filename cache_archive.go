@@ -0,0 +1,411 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var audioTypes = []string{"mp3", "ogg"}
+
+type archiveWriter interface {
+	addFile(name, src string) error
+	Close() error
+}
+
+type tarGzWriter struct {
+	gz *gzip.Writer
+	tw *tar.Writer
+}
+
+type zipWriter struct {
+	zw *zip.Writer
+}
+
+type importStats struct {
+	added, merged, identical, conflicts int
+}
+
+// cacheExportFlags adds options of `cache export` command
+func cacheExportFlags(fs *flag.FlagSet) {
+	config["EXPORT_LANGS"] = ""
+	fs.Func("langs",
+		"comma separated `languages` to export or all. Default is -l value",
+		func(s string) error {
+			for _, lang := range strings.Split(s, ",") {
+				if len(lang) != 2 && lang != "all" {
+					return errors.New("have to be 2 letters language codes or all")
+				}
+			}
+			config["EXPORT_LANGS"] = s
+			return nil
+		})
+}
+
+// cacheExport packs cached index and audio files of selected languages and
+// words into a tar.gz or zip archive
+func cacheExport(cfg Config, args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "archive name is missing")
+		os.Exit(1)
+	}
+	archive := args[0]
+	if err := checkArchiveName(archive); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	words := readWords(cfg, args[1:])
+
+	langs := exportLangs(cfg)
+	var files []string
+	seen := make(map[string]bool)
+	for _, lang := range langs {
+		for _, idxFile := range exportIndexFiles(cfg, lang, words) {
+			data, err := os.ReadFile(idxFile)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			var idx cacheIndex
+			if err = json.Unmarshal(data, &idx); err != nil {
+				fmt.Fprintf(os.Stderr, "broken index file %s: %v\n", idxFile, err)
+				continue
+			}
+			files = append(files, idxFile)
+
+			for _, e := range idx.Entries {
+				for _, atype := range audioTypes {
+					_, file := audioCachePath(cfg, atype, e.ID)
+					if seen[file] {
+						continue
+					}
+					if _, err := os.Stat(file); err == nil {
+						seen[file] = true
+						files = append(files, file)
+					}
+				}
+			}
+		}
+	}
+
+	if len(files) == 0 {
+		fmt.Fprintln(os.Stderr, "nothing to export")
+		os.Exit(1)
+	}
+
+	f, err := os.Create(archive)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	aw, err := newArchiveWriter(f, archive)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	for _, file := range files {
+		name, err := filepath.Rel(cfg["CACHE_DIR"], file)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if cfg["VERBOSE"] == "yes" {
+			fmt.Printf("Export file: `%s`\n", name)
+		}
+		if err = aw.addFile(filepath.ToSlash(name), file); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	if err = aw.Close(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err = f.Close(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Exported %d files to %s\n", len(files), archive)
+}
+
+// exportLangs returns list of languages selected for export
+func exportLangs(cfg Config) []string {
+	if cfg["EXPORT_LANGS"] == "" {
+		return []string{cfg["LANG"]}
+	}
+	if strings.Contains(cfg["EXPORT_LANGS"], "all") {
+		dirs, err := os.ReadDir(filepath.Join(cfg["CACHE_DIR"], cacheIndexDir))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		var langs []string
+		for _, dir := range dirs {
+			if dir.IsDir() {
+				langs = append(langs, dir.Name())
+			}
+		}
+		return langs
+	}
+	return strings.Split(cfg["EXPORT_LANGS"], ",")
+}
+
+// exportIndexFiles returns index files of words in a language. If words are
+// not set returns all index files of the language.
+func exportIndexFiles(cfg Config, lang string, words []string) []string {
+	if words == nil {
+		files, err := filepath.Glob(filepath.Join(cfg["CACHE_DIR"],
+			cacheIndexDir, lang, "*", "*.json"))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		sort.Strings(files)
+		return files
+	}
+
+	var files []string
+	for _, word := range words {
+		file := indexPath(cfg, lang, word)
+		if _, err := os.Stat(file); err != nil {
+			fmt.Fprintf(os.Stderr, "'%s' (%s) is not in cache\n", word, lang)
+			continue
+		}
+		files = append(files, file)
+	}
+	return files
+}
+
+// cacheImport merges archives made by `cache export` into the cache
+func cacheImport(cfg Config, args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "archive name is missing")
+		os.Exit(1)
+	}
+
+	var stats importStats
+	for _, archive := range args {
+		err := walkArchive(archive, func(name string, r io.Reader) error {
+			return importCacheFile(cfg, name, r, &stats)
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "can not import %s: %v\n", archive, err)
+			os.Exit(1)
+		}
+	}
+	fmt.Printf("Imported %d new files, merged %d indexes, "+
+		"skipped %d identical and %d conflicting files\n",
+		stats.added, stats.merged, stats.identical, stats.conflicts)
+}
+
+// importCacheFile puts one file from an archive into the cache. Index files
+// are merged with existing ones, audio files already present in cache are
+// skipped.
+func importCacheFile(cfg Config, name string, r io.Reader, stats *importStats) error {
+	name = path.Clean(name)
+	if path.IsAbs(name) || strings.HasPrefix(name, "../") ||
+		!(strings.HasPrefix(name, cacheIndexDir+"/") ||
+			strings.HasPrefix(name, cacheAudioDir+"/")) {
+		fmt.Fprintf(os.Stderr, "skip unexpected file in archive: %s\n", name)
+		return nil
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	dst := filepath.Join(cfg["CACHE_DIR"], filepath.FromSlash(name))
+	if cfg["VERBOSE"] == "yes" {
+		fmt.Printf("Import file: `%s`\n", name)
+	}
+	if err = os.MkdirAll(filepath.Dir(dst), 0750); err != nil {
+		return err
+	}
+
+	old, err := os.ReadFile(dst)
+	if errors.Is(err, os.ErrNotExist) {
+		stats.added++
+		return os.WriteFile(dst, data, 0640)
+	} else if err != nil {
+		return err
+	}
+
+	if bytes.Equal(old, data) {
+		stats.identical++
+		return nil
+	}
+	if strings.HasPrefix(name, cacheAudioDir+"/") {
+		// audio ids are stable, so keep the file we already have
+		stats.conflicts++
+		return nil
+	}
+
+	merged, err := mergeIndex(old, data)
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	stats.merged++
+	return os.WriteFile(dst, merged, 0640)
+}
+
+// mergeIndex merges two index files keeping order of the first one and
+// adding missing pronunciations from the second
+func mergeIndex(old, data []byte) ([]byte, error) {
+	var idx, newIdx cacheIndex
+	if err := json.Unmarshal(old, &idx); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &newIdx); err != nil {
+		return nil, err
+	}
+
+	ids := make(map[string]bool)
+	for _, e := range idx.Entries {
+		ids[e.ID] = true
+	}
+	for _, e := range newIdx.Entries {
+		if !ids[e.ID] {
+			idx.Entries = append(idx.Entries, e)
+			ids[e.ID] = true
+		}
+	}
+	if newIdx.Updated.After(idx.Updated) {
+		idx.Updated = newIdx.Updated
+	}
+	return json.MarshalIndent(idx, "", "  ")
+}
+
+// newArchiveWriter creates archive writer according to archive file extension
+func newArchiveWriter(w io.Writer, name string) (archiveWriter, error) {
+	switch {
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		gz := gzip.NewWriter(w)
+		return &tarGzWriter{gz: gz, tw: tar.NewWriter(gz)}, nil
+	case strings.HasSuffix(name, ".zip"):
+		return &zipWriter{zw: zip.NewWriter(w)}, nil
+	}
+	return nil, errArchiveFormat
+}
+
+// errArchiveFormat is returned for archive names of unsupported formats
+var errArchiveFormat = errors.New("archive has to be .tar.gz, .tgz or .zip")
+
+// checkArchiveName checks if an archive can be written in the format chosen
+// by its name, so nothing is created for unsupported ones
+func checkArchiveName(name string) error {
+	for _, ext := range []string{".tar.gz", ".tgz", ".zip"} {
+		if strings.HasSuffix(name, ext) {
+			return nil
+		}
+	}
+	return errArchiveFormat
+}
+
+func (a *tarGzWriter) addFile(name, src string) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0640,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	}
+	if err = a.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = a.tw.Write(data)
+	return err
+}
+
+func (a *tarGzWriter) Close() error {
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+	return a.gz.Close()
+}
+
+func (a *zipWriter) addFile(name, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := a.zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	return err
+}
+
+func (a *zipWriter) Close() error {
+	return a.zw.Close()
+}
+
+// walkArchive calls fn for every regular file in tar.gz or zip archive
+func walkArchive(archive string, fn func(name string, r io.Reader) error) error {
+	if strings.HasSuffix(archive, ".zip") {
+		zr, err := zip.OpenReader(archive)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		for _, zf := range zr.File {
+			if zf.FileInfo().IsDir() {
+				continue
+			}
+			r, err := zf.Open()
+			if err != nil {
+				return err
+			}
+			err = fn(zf.Name, r)
+			r.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err = fn(hdr.Name, tr); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+type command struct {
+	name  string
+	args  string
+	descr string
+	flags func(fs *flag.FlagSet)
+	run   func(cfg Config, args []string)
+}
+
+// getCommands define all subcommands of the program. The first words of
+// command line are matched against command names before options parsing.
+func getCommands() []command {
+	return []command{
+		{
+			name:  "cache export",
+			args:  "[options] archive.{tar.gz|zip} [words]",
+			descr: "pack cached audio and metadata of words into an archive",
+			flags: cacheExportFlags,
+			run:   cacheExport,
+		}, {
+			name:  "cache import",
+			args:  "[options] archive.{tar.gz|zip}...",
+			descr: "merge archives made by `cache export` into the cache",
+			run:   cacheImport,
+		}, {
+			name:  "prefetch",
+			args:  "[options] [words]",
+			descr: "fill the cache with pronunciations of words without saving files in current directory",
+			flags: prefetchFlags,
+			run:   prefetch,
+		}, {
+			name:  "playlist",
+			args:  "[options] output.{m3u|pls|wav|mp3|ogg|flac|m4a|opus} [words]",
+			descr: "save pronunciations of words with a playlist of them or join them into a single audio track",
+			flags: playlistFlags,
+			run:   playlist,
+		}, {
+			name:  "export anki",
+			args:  "[options] deck.csv [words]",
+			descr: "save pronunciations of words and write a deck of notes for Anki import",
+			flags: exportAnkiFlags,
+			run:   exportAnki,
+		}, {
+			name:  "history",
+			args:  "[options] [text]",
+			descr: "list or export words looked up before, optionally only words containing text",
+			flags: historyFlags,
+			run:   history,
+		}, {
+			name:  "drill",
+			args:  "[options] [words]",
+			descr: "practise pronunciations of words or words from history with spaced repetition",
+			flags: drillFlags,
+			run:   runDrill,
+		}, {
+			name:  "quiz",
+			args:  "[options] [words]",
+			descr: "play random pronunciations of words or cached words and ask to type the words",
+			flags: quizFlags,
+			run:   runQuiz,
+		},
+	}
+}
+
+// extractCommand looks for a command name at the beginning of command line
+// arguments, removes it from os.Args and returns it. Returns empty string if
+// there is no command.
+func extractCommand() string {
+	for _, cmd := range getCommands() {
+		words := strings.Fields(cmd.name)
+		if len(os.Args) <= len(words) {
+			continue
+		}
+		match := true
+		for i, word := range words {
+			if os.Args[i+1] != word {
+				match = false
+				break
+			}
+		}
+		if match {
+			os.Args = append(os.Args[:1], os.Args[len(words)+1:]...)
+			return cmd.name
+		}
+	}
+	return ""
+}
+
+// lookupCommand returns command by its name
+func lookupCommand(name string) (command, bool) {
+	for _, cmd := range getCommands() {
+		if cmd.name == name {
+			return cmd, true
+		}
+	}
+	return command{}, false
+}
+
+// runCommand executes the command chosen in command line
+func runCommand(cfg Config, args []string) {
+	getHTML = getURL
+	getAudio = downloadFile
+
+	cmd, ok := lookupCommand(cfg["COMMAND"])
+	if !ok {
+		panic("Wrong command (" + cfg["COMMAND"] + "). This should never happen")
+	}
+	cmd.run(cfg, args)
+}
+
+// readWords returns words for a command from arguments, from the file set by
+// -f option or from standard input if it is not a terminal. With -tag option
+// only tagged words are kept, and without other sources all tagged words of
+// the library are returned. Returns nil if there is no source of words.
+func readWords(cfg Config, args []string) []string {
+	words := readInputWords(cfg, args)
+	if cfg["TAG"] != "" {
+		tagged, err := filterTagged(cfg, words)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return tagged
+	}
+	return words
+}
+
+// readInputWords returns words from arguments, -f file or standard input
+func readInputWords(cfg Config, args []string) []string {
+	var words []string
+	for _, word := range args {
+		if word != "" {
+			words = append(words, word)
+		}
+	}
+	if len(words) > 0 {
+		return words
+	}
+
+	in := os.Stdin
+	if cfg["FILE"] != "" {
+		file, err := os.Open(cfg["FILE"])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		in = file
+	} else if term.IsTerminal(int(os.Stdin.Fd())) {
+		return nil
+	}
+
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		word := scanner.Text()
+		if word == "" {
+			continue
+		}
+		words = append(words, word)
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	return words
+}
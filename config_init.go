@@ -8,6 +8,7 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
@@ -36,6 +37,7 @@ func configInit() Config {
 	confFile := getConfigFile(config, configDefaults)
 
 	config = updateFromConfigFile(config, confFile)
+	config["COMMAND"] = extractCommand()
 	updateFromCmdLine(configDefaults)
 	optionsValidation(config)
 
@@ -45,11 +47,20 @@ func configInit() Config {
 
 // optionsValidation check if current flag combination is allowed
 func optionsValidation(cfg Config) {
+	// commands check their arguments by themselves
+	if cfg["COMMAND"] != "" {
+		return
+	}
 	if len(os.Args) > 0 && cfg["FILE"] != "" {
 		fmt.Fprintln(os.Stderr,
 			"you can use only --file options or words in command line, not both")
 		os.Exit(1)
 	}
+	if cfg["RECENT"] == "yes" && (len(os.Args) > 0 || cfg["FILE"] != "") {
+		fmt.Fprintln(os.Stderr,
+			"you can use only --recent option, --file option or words in command line")
+		os.Exit(1)
+	}
 }
 
 // updateFromCmdLine get command line params and update app config values
@@ -58,6 +69,9 @@ func updateFromCmdLine(configDefaults []configFileValue) {
 	fs = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
 	fs.SetOutput(os.Stdout)
 	for _, val := range configDefaults {
+		if val.fname == "" {
+			continue
+		}
 		switch val.ftype {
 		case "yesno":
 			fs.Func(val.fname, val.comment, buildYesNo(val))
@@ -67,15 +81,39 @@ func updateFromCmdLine(configDefaults []configFileValue) {
 			fs.Func(val.fname, val.comment, buildLang(val))
 		case "aformat":
 			fs.Func(val.fname, val.comment, buildAFormat(val))
+		case "number":
+			fs.Func(val.fname, val.comment, buildNumber(val))
+		case "player":
+			fs.Func(val.fname, val.comment, buildPlayer(val))
+		case "command":
+			fs.Func(val.fname, val.comment, buildCommand(val))
+		case "oformat":
+			fs.Func(val.fname, val.comment, buildOFormat(val))
+		case "lufs":
+			fs.Func(val.fname, val.comment, buildLUFS(val))
+		case "speed":
+			fs.Func(val.fname, val.comment, buildSpeed(val))
+		case "keymap":
+			fs.Func(val.fname, val.comment, buildKeymap(val))
 		default:
 			panic("Wrong config type (" + val.ftype + "). This should never happen")
 		}
 	}
+	if cmd, ok := lookupCommand(config["COMMAND"]); ok && cmd.flags != nil {
+		cmd.flags(fs)
+	}
 	pFile := fs.String("f", "", "read input from `filename`")
+	pTag := fs.String("tag", "", "use only words and pronunciations tagged with `tag` in the library, starred for starred ones")
+	pRecent := fs.Bool("recent", false, "look up words from history again, the most recent first")
 	pVersion := fs.Bool("version", false, "print program version")
 	fs.Usage = usage
 	fs.Parse(os.Args[1:])
 	config["FILE"] = *pFile
+	config["TAG"] = *pTag
+	config["RECENT"] = "no"
+	if *pRecent {
+		config["RECENT"] = "yes"
+	}
 	if *pVersion {
 		versionInfo()
 	}
@@ -89,8 +127,22 @@ func versionInfo() {
 
 // usage expand standart usage function from flag package
 func usage() {
-	fmt.Fprintf(fs.Output(), "Usage: %s [options] [words for pronunciation]\n\n",
+	if cmd, ok := lookupCommand(config["COMMAND"]); ok {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s %s\n\n%s\n\n",
+			filepath.Base(os.Args[0]), cmd.name, cmd.args, cmd.descr)
+		fs.PrintDefaults()
+		os.Exit(0)
+	}
+
+	fmt.Fprintf(fs.Output(), "Usage: %s [options] [words for pronunciation]\n",
+		filepath.Base(os.Args[0]))
+	fmt.Fprintf(fs.Output(), "       %s <command> [options] [arguments]\n\n",
 		filepath.Base(os.Args[0]))
+	fmt.Fprint(fs.Output(), "Commands:\n")
+	for _, cmd := range getCommands() {
+		fmt.Fprintf(fs.Output(), "  %s\n\t%s\n", cmd.name, cmd.descr)
+	}
+	fmt.Fprint(fs.Output(), "\nOptions:\n")
 	fmt.Fprint(fs.Output(), "  -f [filename]\n")
 	fmt.Fprint(fs.Output(), "\tfile with words for pronunciation\n")
 	fs.PrintDefaults()
@@ -138,6 +190,84 @@ func buildAFormat(val configFileValue) func(s string) error {
 	}
 }
 
+// buildOFormat parses output audio format args type
+func buildOFormat(val configFileValue) func(s string) error {
+	return func(s string) error {
+		if _, ok := ffmpegCodecs[s]; ok || s == "same" {
+			config[val.key] = s
+			return nil
+		}
+		return errors.New("have to be same, mp3, ogg, wav, flac, m4a or opus")
+	}
+}
+
+// buildLUFS parses loudness args type
+func buildLUFS(val configFileValue) func(s string) error {
+	return func(s string) error {
+		lufs, err := strconv.ParseFloat(s, 64)
+		if err != nil || lufs < -70 || lufs > 0 {
+			return errors.New("have to be a number from -70 to 0")
+		}
+		config[val.key] = s
+		return nil
+	}
+}
+
+// buildPlayer parses audio player args type
+func buildPlayer(val configFileValue) func(s string) error {
+	return func(s string) error {
+		if strings.TrimSpace(s) == "" {
+			return errors.New("have to be auto, native, a known player or a command")
+		}
+		config[val.key] = s
+		return nil
+	}
+}
+
+// buildCommand parses external command args type. Empty value is allowed.
+func buildCommand(val configFileValue) func(s string) error {
+	return func(s string) error {
+		config[val.key] = s
+		return nil
+	}
+}
+
+// buildSpeed parses playback speed args type
+func buildSpeed(val configFileValue) func(s string) error {
+	return func(s string) error {
+		speed, err := strconv.ParseFloat(s, 64)
+		if err != nil || speed < minSpeed || speed > maxSpeed {
+			return fmt.Errorf("have to be a number from %.1f to %.1f",
+				minSpeed, maxSpeed)
+		}
+		config[val.key] = s
+		return nil
+	}
+}
+
+// buildKeymap parses key bindings preset args type
+func buildKeymap(val configFileValue) func(s string) error {
+	return func(s string) error {
+		if _, ok := keymapPresets[s]; !ok {
+			return errors.New("have to be default, vim or emacs")
+		}
+		config[val.key] = s
+		return nil
+	}
+}
+
+// buildNumber parses non-negative integer args type
+func buildNumber(val configFileValue) func(s string) error {
+	return func(s string) error {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return errors.New("have to be a non-negative integer")
+		}
+		config[val.key] = s
+		return nil
+	}
+}
+
 // updateFromConfigFile read config file and updates app config values
 // accordingly.
 func updateFromConfigFile(cfg Config, confFile string) Config {
@@ -151,7 +281,7 @@ func updateFromConfigFile(cfg Config, confFile string) Config {
 	}
 	defer cFile.Close()
 
-	iniLine := regexp.MustCompile(`^\s*(\w+)=([\w\./\\]+)\s*`)
+	iniLine := regexp.MustCompile(`^\s*(\w+)=(.*?)\s*$`)
 	var cnt int
 	scanner := bufio.NewScanner(cFile)
 	for scanner.Scan() {
@@ -249,6 +379,11 @@ func getDefaultConfigValues() []configFileValue {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
+	userConfDir, err := os.UserConfigDir()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 
 	configDefaults := []configFileValue{
 		{
@@ -263,6 +398,12 @@ func getDefaultConfigValues() []configFileValue {
 			value:   "yes",
 			fname:   "check",
 			ftype:   "yesno",
+		}, {
+			comment: "check cached audio for silent, clipped, noisy, too short or too long recordings `[yes | no]`. They go last in batch mode and are marked in interactive mode. Default yes",
+			key:     "QUALITY_CHECK",
+			value:   "yes",
+			fname:   "quality",
+			ftype:   "yesno",
 		}, {
 			comment: "download audio files in current directory `[yes | no]`. Default yes",
 			key:     "DOWNLOAD",
@@ -281,6 +422,30 @@ func getDefaultConfigValues() []configFileValue {
 			value:   userCacheDir + "/tellme",
 			fname:   "cache-dir",
 			ftype:   "path",
+		}, {
+			comment: "file with starred and tagged pronunciations `[any valid path]`. Default " + userConfDir + "/tellme/library.json",
+			key:     "LIBRARY",
+			value:   userConfDir + "/tellme/library.json",
+			fname:   "library",
+			ftype:   "path",
+		}, {
+			comment: "file with history of looked up words `[any valid path]`. Empty value disables history. Default " + userConfDir + "/tellme/history.jsonl",
+			key:     "HISTORY",
+			value:   userConfDir + "/tellme/history.jsonl",
+			fname:   "history",
+			ftype:   "path",
+		}, {
+			comment: "file with review schedule of drill command `[any valid path]`. Default " + userConfDir + "/tellme/drill.json",
+			key:     "DRILL",
+			value:   userConfDir + "/tellme/drill.json",
+			fname:   "drill",
+			ftype:   "path",
+		}, {
+			comment: "days to use cached pronunciation lists before updating them `[number]`. 0 means forever. Default 30",
+			key:     "INDEX_MAX_AGE",
+			value:   "30",
+			fname:   "index-max-age",
+			ftype:   "number",
 		}, {
 			comment: "language `[en | es | de | etc]`. Default en",
 			key:     "LANG",
@@ -293,6 +458,90 @@ func getDefaultConfigValues() []configFileValue {
 			value:   "mp3",
 			fname:   "t",
 			ftype:   "aformat",
+		}, {
+			comment: "format of saved audio files `[same | mp3 | ogg | wav | flac | m4a | opus]`. Default same as downloaded",
+			key:     "OUTPUT_FORMAT",
+			value:   "same",
+			fname:   "o",
+			ftype:   "oformat",
+		}, {
+			comment: "trim leading and trailing silence of saved files `[yes | no]`. Default no",
+			key:     "TRIM_SILENCE",
+			value:   "no",
+			fname:   "trim",
+			ftype:   "yesno",
+		}, {
+			comment: "normalize loudness of saved files `[yes | no]`. Default no",
+			key:     "NORMALIZE",
+			value:   "no",
+			fname:   "normalize",
+			ftype:   "yesno",
+		}, {
+			comment: "target loudness of normalization in LUFS `[-70 - 0]`. Default -16",
+			key:     "TARGET_LUFS",
+			value:   "-16",
+			fname:   "lufs",
+			ftype:   "lufs",
+		}, {
+			comment: "write word, author and language tags into saved files `[yes | no]`. Default yes",
+			key:     "TAGS",
+			value:   "yes",
+			fname:   "tags",
+			ftype:   "yesno",
+		}, {
+			comment: "audio player `[auto | native | mpg123 | mpv | ffplay | paplay | play | command]`. Command may contain {file} placeholder. Default auto",
+			key:     "PLAYER",
+			value:   "auto",
+			fname:   "player",
+			ftype:   "player",
+		}, {
+			comment: "audio player for mp3 files `[command]`. Default is PLAYER value",
+			key:     "PLAYER_MP3",
+			value:   "",
+			fname:   "player-mp3",
+			ftype:   "command",
+		}, {
+			comment: "audio player for ogg files `[command]`. Default is PLAYER value",
+			key:     "PLAYER_OGG",
+			value:   "",
+			fname:   "player-ogg",
+			ftype:   "command",
+		}, {
+			comment: "playback speed `[0.5 - 2.0]`. Default 1.0",
+			key:     "SPEED",
+			value:   "1.0",
+			fname:   "speed",
+			ftype:   "speed",
+		}, {
+			comment: "how many times to play a pronunciation `[number]`. Default 1",
+			key:     "REPEAT",
+			value:   "1",
+			fname:   "repeat",
+			ftype:   "number",
+		}, {
+			comment: "pause between repeats in milliseconds `[number]`. Default 700",
+			key:     "REPEAT_GAP",
+			value:   "700",
+			fname:   "repeat-gap",
+			ftype:   "number",
+		}, {
+			comment: "text-to-speech `command` announcing words in playlist tracks. Use {text} and {file} placeholders for the word and the wav file to write. Default none",
+			key:     "TTS",
+			value:   "",
+			fname:   "tts",
+			ftype:   "command",
+		}, {
+			comment: "recorder `command` to compare your pronunciation with a native one. Use {file} and {seconds} placeholders for the wav file to write and recording time. Default arecord -q -f cd -d {seconds} {file}",
+			key:     "RECORDER",
+			value:   "arecord -q -f cd -d {seconds} {file}",
+			fname:   "recorder",
+			ftype:   "command",
+		}, {
+			comment: "key bindings of interactive mode `[default | vim | emacs]`. Default default",
+			key:     "KEYMAP",
+			value:   "default",
+			fname:   "keymap",
+			ftype:   "keymap",
 		}, {
 			comment: "verbose mode `[yes | no]`. Default no",
 			key:     "VERBOSE",
@@ -301,6 +550,15 @@ func getDefaultConfigValues() []configFileValue {
 			ftype:   "yesno",
 		},
 	}
+	// bindings of single actions are set only in the config file
+	for _, action := range keyActions {
+		configDefaults = append(configDefaults, configFileValue{
+			comment: "keys to " + action.descr + " separated by spaces. Default from KEYMAP",
+			key:     "KEY_" + strings.ToUpper(action.name),
+			value:   "",
+			ftype:   "keys",
+		})
+	}
 	return configDefaults
 }
 
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// ffmpegCodecs are ffmpeg encoder options for supported output formats
+var ffmpegCodecs = map[string][]string{
+	"mp3":  {"-c:a", "libmp3lame", "-q:a", "2"},
+	"ogg":  {"-c:a", "libvorbis", "-q:a", "5"},
+	"wav":  {"-c:a", "pcm_s16le"},
+	"flac": {"-c:a", "flac"},
+	"m4a":  {"-c:a", "aac", "-b:a", "128k"},
+	"opus": {"-c:a", "libopus", "-b:a", "64k"},
+}
+
+// outputFormat returns format of files saved in current directory
+func outputFormat(cfg Config) string {
+	if cfg["OUTPUT_FORMAT"] == "" || cfg["OUTPUT_FORMAT"] == "same" {
+		return cfg["ATYPE"]
+	}
+	return cfg["OUTPUT_FORMAT"]
+}
+
+// exportAudio puts audio file of a pronunciation from the cache (or
+// a temporary file) to its destination. The file is processed and converted
+// to the output format if needed and tagged.
+func exportAudio(cfg Config, item Pron, src string) error {
+	if processingEnabled(cfg) {
+		processed, err := processAudio(cfg, src)
+		if err != nil {
+			return err
+		}
+		src = processed
+	}
+	if err := convertAudio(cfg, src, item.aFile); err != nil {
+		return err
+	}
+	// the file is saved already, so untagged file is not an error
+	if err := tagAudio(cfg, item, item.aFile); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	return nil
+}
+
+// convertAudio transcodes src audio file to dst. Formats are taken from file
+// extensions. ffmpeg is used if it is installed, wav files can also be
+// written without it.
+func convertAudio(cfg Config, src, dst string) error {
+	srcFormat := strings.TrimPrefix(filepath.Ext(src), ".")
+	dstFormat := strings.TrimPrefix(filepath.Ext(dst), ".")
+	if srcFormat == dstFormat {
+		return copyFile(cfg, src, dst)
+	}
+	if cfg["VERBOSE"] == "yes" {
+		fmt.Printf("Convert file: `%s` -> `%s`\n", src, dst)
+	}
+
+	codec, ok := ffmpegCodecs[dstFormat]
+	if !ok {
+		return fmt.Errorf("can not convert audio to unknown format %s", dstFormat)
+	}
+	if _, err := exec.LookPath("ffmpeg"); err == nil {
+		args := []string{"-y", "-loglevel", "error", "-i", src, "-vn"}
+		args = append(args, codec...)
+		args = append(args, dst)
+		out, err := exec.Command("ffmpeg", args...).CombinedOutput()
+		if err != nil {
+			os.Remove(dst)
+			return fmt.Errorf("ffmpeg can not convert %s: %v: %s", src, err,
+				strings.TrimSpace(string(out)))
+		}
+		return nil
+	}
+
+	if dstFormat == "wav" {
+		audio, err := decodeAudio(src)
+		if err != nil {
+			return err
+		}
+		return writeWav(dst, audio)
+	}
+	return fmt.Errorf("ffmpeg is needed to convert audio to %s, "+
+		"install it or use wav output format", dstFormat)
+}
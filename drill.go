@@ -0,0 +1,396 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// grades of answers in drill mode
+const (
+	gradeAgain = iota + 1
+	gradeHard
+	gradeGood
+	gradeEasy
+)
+
+// gradeNames are names of grades shown in drill mode
+var gradeNames = []string{"", "again", "hard", "good", "easy"}
+
+// minEase is the lowest ease factor of SM-2 algorithm
+const minEase = 1.3
+
+// drillCard is a word scheduled for review with SM-2 algorithm
+type drillCard struct {
+	Word     string    `json:"word"`
+	Lang     string    `json:"lang"`
+	Ease     float64   `json:"ease"`
+	Interval int       `json:"interval"`
+	Reps     int       `json:"reps"`
+	Lapses   int       `json:"lapses"`
+	Due      time.Time `json:"due"`
+}
+
+// drillStore is a file with all cards of drill mode
+type drillStore struct {
+	path  string
+	Cards []*drillCard `json:"cards"`
+}
+
+// drill is a drill session: cards in queue are played one by one and user
+// grades how well the words are known
+type drill struct {
+	*session
+	store    *drillStore
+	queue    []*drillCard
+	isNew    map[*drillCard]bool
+	card     *drillCard
+	pron     *Pron
+	revealed bool
+	graded   [5]int
+}
+
+// newCard returns a card of a word never reviewed before
+func newCard(word, lang string) *drillCard {
+	return &drillCard{Word: word, Lang: lang, Ease: 2.5}
+}
+
+// grade schedules the next review of a card with SM-2 algorithm. Grades
+// from again to easy are quality 2 to 5 of the original algorithm.
+func (c *drillCard) grade(grade int, now time.Time) {
+	q := float64(grade + 1)
+	if grade == gradeAgain {
+		c.Reps = 0
+		c.Lapses++
+		c.Interval = 1
+	} else {
+		c.Reps++
+		switch c.Reps {
+		case 1:
+			c.Interval = 1
+		case 2:
+			c.Interval = 6
+		default:
+			c.Interval = int(math.Round(float64(c.Interval) * c.Ease))
+		}
+	}
+	c.Ease += 0.1 - (5-q)*(0.08+(5-q)*0.02)
+	if c.Ease < minEase {
+		c.Ease = minEase
+	}
+	c.Due = now.AddDate(0, 0, c.Interval)
+}
+
+// loadDrillStore reads cards from a file. Missing file gives an empty store.
+func loadDrillStore(path string) (*drillStore, error) {
+	store := &drillStore{path: path}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, store); err != nil {
+		return nil, fmt.Errorf("broken drill file %s: %v", path, err)
+	}
+	return store, nil
+}
+
+// save writes cards to the store file
+func (st *drillStore) save() error {
+	if err := os.MkdirAll(filepath.Dir(st.path), 0750); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := st.path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, st.path)
+}
+
+// card returns card of a word or nil if the word has never been reviewed
+func (st *drillStore) card(word, lang string) *drillCard {
+	for _, c := range st.Cards {
+		if c.Word == word && c.Lang == lang {
+			return c
+		}
+	}
+	return nil
+}
+
+// dueCards returns cards of words due for review and at most newLimit cards
+// of new words. Without words all due cards of the language are returned.
+// Due cards go first, the most overdue first.
+func (st *drillStore) dueCards(words []string, lang string, newLimit int,
+	now time.Time) (due, fresh []*drillCard) {
+	if len(words) == 0 {
+		for _, c := range st.Cards {
+			if c.Lang == lang && !c.Due.After(now) {
+				due = append(due, c)
+			}
+		}
+	}
+	seen := make(map[string]bool)
+	for _, word := range words {
+		if seen[word] {
+			continue
+		}
+		seen[word] = true
+		c := st.card(word, lang)
+		switch {
+		case c == nil && len(fresh) < newLimit:
+			fresh = append(fresh, newCard(word, lang))
+		case c != nil && !c.Due.After(now):
+			due = append(due, c)
+		}
+	}
+	sort.SliceStable(due, func(i, j int) bool { return due[i].Due.Before(due[j].Due) })
+	return due, fresh
+}
+
+// drillFlags adds options of `drill` command
+func drillFlags(fs *flag.FlagSet) {
+	config["DRILL_NEW"] = "10"
+	fs.Func("new", "add at most `N` new words to the session. Default 10",
+		func(s string) error {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				return errors.New("have to be a non-negative integer")
+			}
+			config["DRILL_NEW"] = s
+			return nil
+		})
+}
+
+// runDrill practises pronunciations of words: it plays a word, shows it when
+// user is ready and asks how well user knew it. Words come from arguments or
+// -f file, and only those of them which are due or new are reviewed. Without
+// words all due cards are reviewed and new words come from history.
+func runDrill(cfg Config, args []string) {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		fmt.Fprintln(os.Stderr, "drill needs a terminal")
+		os.Exit(1)
+	}
+	// audio is played from the cache or temporary files only
+	cfg["DOWNLOAD"] = "no"
+	cfg["INTERACTIVE"] = "yes"
+	d, err := newDrill(cfg, readWords(cfg, args))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if len(d.queue) == 0 {
+		fmt.Println("Nothing to review." + d.nextReview())
+		return
+	}
+
+	tmpDir, err = os.MkdirTemp("", "tellme")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer os.RemoveAll(tmpDir)
+	if err = d.fullScreen(d.run); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Println(d.summary())
+}
+
+// newDrill prepares a drill session of words. Without words new cards are
+// made of words from history.
+func newDrill(cfg Config, words []string) (*drill, error) {
+	s, err := newSession(cfg)
+	if err != nil {
+		return nil, err
+	}
+	store, err := loadDrillStore(cfg["DRILL"])
+	if err != nil {
+		return nil, err
+	}
+	newLimit, _ := strconv.Atoi(cfg["DRILL_NEW"])
+
+	d := &drill{session: s, store: store, isNew: make(map[*drillCard]bool)}
+	due, fresh := store.dueCards(words, cfg["LANG"], newLimit, time.Now())
+	// all due cards are already taken, history gives only new words
+	if len(words) == 0 {
+		entries, err := readHistory(cfg["HISTORY"])
+		if err != nil {
+			return nil, err
+		}
+		_, fresh = store.dueCards(recentWords(entries, cfg["LANG"]), cfg["LANG"],
+			newLimit, time.Now())
+	}
+	for _, c := range fresh {
+		d.isNew[c] = true
+	}
+	d.queue = append(due, fresh...)
+	s.screen = d.render
+	return d, nil
+}
+
+// run shows cards until the queue is empty or user quits
+func (d *drill) run() {
+	defer d.stop()
+	for d.nextCard() {
+		replay := true
+		for d.card != nil {
+			if replay {
+				d.play(*d.pron)
+			}
+			d.draw()
+			key, ok := d.nextKey()
+			if !ok {
+				return
+			}
+			var quit bool
+			replay, quit = d.handle(key)
+			if quit {
+				return
+			}
+		}
+	}
+}
+
+// nextCard takes the next card with pronunciations from the queue. Returns
+// false if the queue is empty.
+func (d *drill) nextCard() bool {
+	for len(d.queue) > 0 {
+		c := d.queue[0]
+		d.queue = d.queue[1:]
+		d.setStatus(fmt.Sprintf("Loading `%s`...", c.Word))
+		d.draw()
+		list := getPronList(d.cfg, c.Word)
+		if len(list) == 0 {
+			continue
+		}
+		// every review uses another speaker
+		item := list[(c.Reps+c.Lapses)%len(list)]
+		d.card, d.pron, d.revealed = c, &item, false
+		d.setStatus("")
+		return true
+	}
+	return false
+}
+
+// handle reacts to a key. Returns true if the pronunciation has to be played
+// again and true if user wants to quit.
+func (d *drill) handle(key string) (replay, quit bool) {
+	switch action := d.keymap.action(key); action {
+	case "quit":
+		return false, true
+	case "replay":
+		return true, false
+	case "faster", "slower":
+		changeSpeed(d.cfg, action == "faster")
+		return true, false
+	}
+
+	if !d.revealed {
+		if name := keyName(key); name == "space" || name == "enter" {
+			d.revealed = true
+		}
+		return false, false
+	}
+	grade, err := strconv.Atoi(key)
+	if err != nil || grade < gradeAgain || grade > gradeEasy {
+		return false, false
+	}
+	d.card.grade(grade, time.Now())
+	d.graded[grade]++
+	if d.isNew[d.card] {
+		d.store.Cards = append(d.store.Cards, d.card)
+		delete(d.isNew, d.card)
+	}
+	if err = d.store.save(); err != nil {
+		d.setStatus(err.Error())
+	}
+	// forgotten words come back at the end of the session
+	if grade == gradeAgain {
+		d.queue = append(d.queue, d.card)
+	}
+	d.card = nil
+	return false, false
+}
+
+// render returns screen lines of drill mode
+func (d *drill) render(width, height int) []string {
+	if width < tuiMinWidth {
+		width = tuiMinWidth
+	}
+	if height < tuiMinHeight {
+		height = tuiMinHeight
+	}
+	blank := strings.Repeat(" ", width)
+	lines := []string{ansiReverse + fit(fmt.Sprintf(" tellme-go drill  [%s]",
+		d.cfg["LANG"]), width) + ansiReset, blank}
+
+	if c := d.card; c != nil {
+		kind := fmt.Sprintf("review, interval %dd", c.Interval)
+		if d.isNew[c] {
+			kind = "new word"
+		}
+		lines = append(lines, fit("   "+kind, width), blank)
+		if d.revealed {
+			lines = append(lines, "   "+ansiBold+fit(c.Word, width-3)+ansiReset,
+				fit(fmt.Sprintf("   %s (%s from %s)", d.pron.author, d.pron.sex,
+					d.pron.country), width), blank,
+				fit("   How well did you know it?  1:again  2:hard  3:good  4:easy", width))
+		} else {
+			lines = append(lines, fit("   ???", width), blank, blank,
+				fit("   Listen and recall the word, then press Space to check", width))
+		}
+	}
+	for len(lines) < height-2 {
+		lines = append(lines, blank)
+	}
+	lines = lines[:height-2]
+
+	status := fmt.Sprintf(" left %d  done %d  speed %.1fx", len(d.queue),
+		d.graded[gradeHard]+d.graded[gradeGood]+d.graded[gradeEasy],
+		playbackSpeed(d.cfg))
+	if d.status != "" {
+		status += "  │ " + d.status
+	}
+	help := fmt.Sprintf("%s:replay  %s/%s:speed  %s:quit", d.keymap.label("replay"),
+		d.keymap.label("faster"), d.keymap.label("slower"), d.keymap.label("quit"))
+	return append(lines, ansiReverse+fit(status, width)+ansiReset, fit(help, width))
+}
+
+// summary returns results of the session
+func (d *drill) summary() string {
+	var parts []string
+	for grade := gradeAgain; grade <= gradeEasy; grade++ {
+		parts = append(parts, fmt.Sprintf("%s %d", gradeNames[grade], d.graded[grade]))
+	}
+	return "Reviewed: " + strings.Join(parts, ", ") + "." + d.nextReview()
+}
+
+// nextReview returns when the next card of the language is due
+func (d *drill) nextReview() string {
+	var next time.Time
+	for _, c := range d.store.Cards {
+		if c.Lang == d.cfg["LANG"] && (next.IsZero() || c.Due.Before(next)) {
+			next = c.Due
+		}
+	}
+	if next.IsZero() {
+		return ""
+	}
+	return " Next review: " + next.Local().Format("2006-01-02 15:04") + "."
+}
@@ -2,6 +2,15 @@ module git.pinacotheca.net/ghoust/tellme-go
 
 go 1.19
 
-require golang.org/x/term v0.4.0
+require (
+	github.com/hajimehoshi/go-mp3 v0.3.4
+	github.com/jfreymuth/oggvorbis v1.0.5
+	github.com/jfreymuth/pulse v0.1.1
+	golang.org/x/term v0.4.0
+	golang.org/x/text v0.6.0
+)
 
-require golang.org/x/sys v0.4.0 // indirect
+require (
+	github.com/jfreymuth/vorbis v1.0.2 // indirect
+	golang.org/x/sys v0.4.0 // indirect
+)
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// historyEntry is a looked up word with the pronunciation user has chosen.
+// Author and ID are empty if the word has no pronunciations.
+type historyEntry struct {
+	Word    string    `json:"word"`
+	Lang    string    `json:"lang"`
+	Time    time.Time `json:"time"`
+	Author  string    `json:"author,omitempty"`
+	Country string    `json:"country,omitempty"`
+	ID      string    `json:"id,omitempty"`
+}
+
+// addHistory appends a looked up word to the history file set by
+// cfg["HISTORY"]. Empty HISTORY disables history.
+func addHistory(cfg Config, word string, item Pron) error {
+	if cfg["HISTORY"] == "" {
+		return nil
+	}
+	entry := historyEntry{
+		Word:    word,
+		Lang:    cfg["LANG"],
+		Time:    time.Now(),
+		Author:  item.author,
+		Country: item.country,
+		ID:      item.id,
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(cfg["HISTORY"]), 0750); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(cfg["HISTORY"], os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readHistory reads all entries of a history file. Missing file is an empty
+// history.
+func readHistory(path string) ([]historyEntry, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []historyEntry
+	var cnt int
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		cnt++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry historyEntry
+		if err = json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("error in history file %v, line %v", path, cnt)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// recentWords returns words of a language from history without repeats,
+// the most recent first
+func recentWords(entries []historyEntry, lang string) []string {
+	var words []string
+	seen := make(map[string]bool)
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if e.Lang == lang && !seen[e.Word] {
+			seen[e.Word] = true
+			words = append(words, e.Word)
+		}
+	}
+	return words
+}
+
+// historyWords returns words of the current language from history, the most
+// recent first. Returns error if there are no such words.
+func historyWords(cfg Config) ([]string, error) {
+	entries, err := readHistory(cfg["HISTORY"])
+	if err != nil {
+		return nil, err
+	}
+	words := recentWords(entries, cfg["LANG"])
+	if len(words) == 0 {
+		return nil, fmt.Errorf("no words of language '%s' in history", cfg["LANG"])
+	}
+	return words, nil
+}
+
+// searchHistory returns entries with words containing text ignoring case
+func searchHistory(entries []historyEntry, text string) []historyEntry {
+	if text == "" {
+		return entries
+	}
+	text = strings.ToLower(text)
+	var result []historyEntry
+	for _, e := range entries {
+		if strings.Contains(strings.ToLower(e.Word), text) {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+// historyFlags adds options of `history` command
+func historyFlags(fs *flag.FlagSet) {
+	config["HISTORY_LIMIT"] = "20"
+	config["HISTORY_EXPORT"] = ""
+	fs.Func("n", "show only `N` last entries, 0 for all. Default 20",
+		func(s string) error {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				return errors.New("have to be a non-negative integer")
+			}
+			config["HISTORY_LIMIT"] = s
+			return nil
+		})
+	fs.Func("export", "write found entries to `file`: .csv, .json or .txt with one word per line",
+		func(s string) error {
+			switch filepath.Ext(s) {
+			case ".csv", ".json", ".txt":
+				config["HISTORY_EXPORT"] = s
+				return nil
+			}
+			return errors.New("have to be .csv, .json or .txt file")
+		})
+}
+
+// history lists words looked up before. Arguments are searched in words.
+// With -export option all found entries are written to a file.
+func history(cfg Config, args []string) {
+	entries, err := readHistory(cfg["HISTORY"])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	entries = searchHistory(entries, strings.Join(args, " "))
+
+	if cfg["HISTORY_EXPORT"] != "" {
+		if err = exportHistory(cfg["HISTORY_EXPORT"], entries); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Exported %d entries to %s\n", len(entries), cfg["HISTORY_EXPORT"])
+		return
+	}
+
+	limit, _ := strconv.Atoi(cfg["HISTORY_LIMIT"])
+	if limit > 0 && len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+	for _, e := range entries {
+		line := fmt.Sprintf("%s  %s  %s", e.Time.Local().Format("2006-01-02 15:04"),
+			e.Lang, e.Word)
+		if e.Author != "" {
+			line += fmt.Sprintf("  (%s from %s)", e.Author, e.Country)
+		}
+		fmt.Println(line)
+	}
+}
+
+// exportHistory writes history entries to a file in format chosen by its
+// extension
+func exportHistory(path string, entries []historyEntry) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	switch filepath.Ext(path) {
+	case ".json":
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		if entries == nil {
+			entries = []historyEntry{}
+		}
+		err = enc.Encode(entries)
+	case ".csv":
+		w := csv.NewWriter(f)
+		w.Write([]string{"time", "lang", "word", "author", "country", "id"})
+		for _, e := range entries {
+			w.Write([]string{e.Time.Format(time.RFC3339), e.Lang, e.Word,
+				e.Author, e.Country, e.ID})
+		}
+		w.Flush()
+		err = w.Error()
+	default:
+		// plain list of words can be used with -f option
+		seen := make(map[string]bool)
+		for _, e := range entries {
+			if !seen[e.Word] {
+				seen[e.Word] = true
+				fmt.Fprintln(f, e.Word)
+			}
+		}
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
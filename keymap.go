@@ -0,0 +1,361 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// keyAction is an action of interactive mode which can be bound to keys
+type keyAction struct {
+	name  string
+	descr string
+}
+
+// keyActions are all actions of interactive mode. Config keys of bindings
+// are KEY_ and upper case action name.
+var keyActions = []keyAction{
+	{"next_pron", "next pronunciation"},
+	{"prev_pron", "previous pronunciation"},
+	{"next_word", "next word"},
+	{"prev_word", "previous word"},
+	{"replay", "replay sound"},
+	{"faster", "increase playback speed"},
+	{"slower", "decrease playback speed"},
+	{"retry", "try to load the word again"},
+	{"save", "save the pronunciation to the current directory"},
+	{"star", "star the pronunciation or remove the star"},
+	{"tag", "tag the pronunciation"},
+	{"compare", "play one pronunciation of every country to compare accents"},
+	{"record", "record yourself and play it after the pronunciation"},
+	{"new_word", "enter a new word"},
+	{"accept_suggestion", "replace a word without pronunciations with the chosen similar word"},
+	{"quit", "quit"},
+}
+
+// suggestionActions are actions used only while similar words are offered,
+// so their keys can be bound to other actions as well
+var suggestionActions = map[string]bool{"accept_suggestion": true}
+
+// keymapPresets are sets of key bindings for actions. Keys of an action are
+// separated by spaces.
+var keymapPresets = map[string]map[string]string{
+	"default": {
+		"next_pron":         "j down",
+		"prev_pron":         "k up",
+		"next_word":         "n enter right",
+		"prev_word":         "p left",
+		"replay":            "r",
+		"faster":            "+",
+		"slower":            "-",
+		"retry":             "t",
+		"save":              "s",
+		"star":              "*",
+		"tag":               "g",
+		"compare":           "c",
+		"record":            "v",
+		"new_word":          "e",
+		"accept_suggestion": "enter",
+		"quit":              "q ctrl-c",
+	},
+	"vim": {
+		"next_pron":         "j down",
+		"prev_pron":         "k up",
+		"next_word":         "l enter right",
+		"prev_word":         "h left",
+		"replay":            "r .",
+		"faster":            "+",
+		"slower":            "-",
+		"retry":             "u",
+		"save":              "w",
+		"star":              "*",
+		"tag":               "m",
+		"compare":           "c",
+		"record":            "v",
+		"new_word":          "o i",
+		"accept_suggestion": "enter",
+		"quit":              "q ctrl-c",
+	},
+	"emacs": {
+		"next_pron":         "ctrl-n down",
+		"prev_pron":         "ctrl-p up",
+		"next_word":         "ctrl-f enter right",
+		"prev_word":         "ctrl-b left",
+		"replay":            "ctrl-r",
+		"faster":            "+",
+		"slower":            "-",
+		"retry":             "ctrl-t",
+		"save":              "ctrl-w",
+		"star":              "alt-s",
+		"tag":               "alt-t",
+		"compare":           "alt-c",
+		"record":            "alt-v",
+		"new_word":          "ctrl-s",
+		"accept_suggestion": "enter",
+		"quit":              "ctrl-g ctrl-c ctrl-x",
+	},
+}
+
+// keyNames are names of keys which are not printable characters
+var keyNames = map[string]string{
+	"\n":   "enter",
+	" ":    "space",
+	"\t":   "tab",
+	"\x1b": "esc",
+	"\x7f": "backspace",
+	"\b":   "backspace",
+}
+
+// escapeKeyNames are names of keys sent by terminals as escape sequences
+var escapeKeyNames = []string{"up", "down", "right", "left", "home", "end",
+	"pgup", "pgdown", "insert", "delete", "shift-tab", "f1", "f2", "f3", "f4",
+	"f5", "f6", "f7", "f8", "f9", "f10", "f11", "f12"}
+
+// keymap holds key bindings of interactive mode
+type keymap struct {
+	actions map[string]string   // key name -> action
+	keys    map[string][]string // action -> key names in config order
+}
+
+// newKeymap builds key bindings from cfg["KEYMAP"] preset and KEY_<ACTION>
+// overrides
+func newKeymap(cfg Config) (*keymap, error) {
+	presetName := cfg["KEYMAP"]
+	if presetName == "" {
+		presetName = "default"
+	}
+	preset, ok := keymapPresets[presetName]
+	if !ok {
+		return nil, fmt.Errorf("unknown keymap preset: %s", presetName)
+	}
+
+	km := &keymap{actions: make(map[string]string), keys: make(map[string][]string)}
+	for _, action := range keyActions {
+		keys := preset[action.name]
+		if custom := cfg["KEY_"+strings.ToUpper(action.name)]; custom != "" {
+			keys = custom
+		}
+		for _, key := range strings.Fields(keys) {
+			if !validKeyName(key) {
+				return nil, fmt.Errorf("wrong key `%s` for %s", key, action.name)
+			}
+			key = normalizeKey(key)
+			if suggestionActions[action.name] {
+				km.keys[action.name] = append(km.keys[action.name], key)
+				continue
+			}
+			if other, ok := km.actions[key]; ok && other != action.name {
+				return nil, fmt.Errorf("key `%s` is bound to both %s and %s",
+					key, other, action.name)
+			}
+			km.actions[key] = action.name
+			km.keys[action.name] = append(km.keys[action.name], key)
+		}
+	}
+	return km, nil
+}
+
+// action returns action bound to a key returned by getChar
+func (km *keymap) action(key string) string {
+	return km.actions[keyName(key)]
+}
+
+// bound checks if a key returned by getChar is bound to action. Keys of
+// suggestion actions are found only this way.
+func (km *keymap) bound(key, action string) bool {
+	for _, k := range km.keys[action] {
+		if k == keyName(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// validKeyName checks that a key name from config can be produced by
+// keyName
+func validKeyName(key string) bool {
+	if len([]rune(key)) == 1 {
+		return key > " " && key != "\x7f"
+	}
+	for _, name := range keyNames {
+		if key == name {
+			return true
+		}
+	}
+	for _, name := range escapeKeyNames {
+		if key == name || strings.HasSuffix(key, "-"+name) &&
+			validModifiers(strings.TrimSuffix(key, name)) {
+			return true
+		}
+	}
+	if strings.HasPrefix(key, "ctrl-") && len(key) == 6 {
+		return key[5] >= 'a' && key[5] <= 'z'
+	}
+	if strings.HasPrefix(key, "alt-") {
+		return len([]rune(key)) == 5
+	}
+	return false
+}
+
+// keyModifiers are modifiers of key names in the order getChar uses
+var keyModifiers = []string{"ctrl", "alt", "shift"}
+
+// controlKeyAliases are control keys which terminals send as the same
+// characters as named keys
+var controlKeyAliases = map[string]string{
+	"ctrl-h": "backspace",
+	"ctrl-i": "tab",
+	"ctrl-j": "enter",
+	"ctrl-m": "enter",
+}
+
+// normalizeKey puts modifiers of a key name into the order used by getChar,
+// so "shift-ctrl-up" becomes "ctrl-shift-up". Control keys sent as named
+// keys get their names, so "ctrl-m" becomes "enter".
+func normalizeKey(key string) string {
+	if name, ok := controlKeyAliases[key]; ok {
+		return name
+	}
+	parts := strings.Split(key, "-")
+	if len(parts) < 2 || len([]rune(key)) == 1 {
+		return key
+	}
+	base := parts[len(parts)-1]
+	used := make(map[string]bool)
+	for _, mod := range parts[:len(parts)-1] {
+		used[mod] = true
+	}
+	var result []string
+	for _, mod := range keyModifiers {
+		if used[mod] {
+			result = append(result, mod)
+		}
+	}
+	return strings.Join(append(result, base), "-")
+}
+
+// validModifiers checks modifier prefix of a key name like "ctrl-shift-"
+func validModifiers(prefix string) bool {
+	for _, mod := range strings.Split(strings.TrimSuffix(prefix, "-"), "-") {
+		if mod != "ctrl" && mod != "alt" && mod != "shift" {
+			return false
+		}
+	}
+	return true
+}
+
+// keyName returns name of a key returned by getChar as it is used in
+// keymaps: printable characters are names of themselves, control characters
+// are "ctrl-a" .. "ctrl-z"
+func keyName(key string) string {
+	if name, ok := keyNames[key]; ok {
+		return name
+	}
+	if len(key) == 1 && key[0] >= 1 && key[0] <= 26 {
+		return "ctrl-" + string(rune('a'+key[0]-1))
+	}
+	return key
+}
+
+// keyLabel returns short label of a key for the help line
+func keyLabel(key string) string {
+	switch key {
+	case "up":
+		return "↑"
+	case "down":
+		return "↓"
+	case "right":
+		return "→"
+	case "left":
+		return "←"
+	case "enter":
+		return "Enter"
+	}
+	if strings.HasPrefix(key, "ctrl-") && len(key) == 6 {
+		return "^" + strings.ToUpper(key[5:])
+	}
+	return key
+}
+
+// label returns label of the first key bound to action
+func (km *keymap) label(action string) string {
+	keys := km.keys[action]
+	if len(keys) == 0 {
+		return ""
+	}
+	return keyLabel(keys[0])
+}
+
+// helpLine returns description of key bindings for the status bar
+func (km *keymap) helpLine() string {
+	label := km.label
+	pair := func(a, b string) string {
+		return label(a) + "/" + label(b)
+	}
+	items := []string{
+		pair("next_pron", "prev_pron") + ":pronunciation",
+		pair("next_word", "prev_word") + ":word",
+		"0-9:choose",
+		label("replay") + ":replay",
+		pair("faster", "slower") + ":speed",
+		label("retry") + ":try again",
+		label("save") + ":save",
+		label("star") + ":star",
+		label("tag") + ":tag",
+		label("compare") + ":accents",
+		label("record") + ":record",
+		label("new_word") + ":new word",
+		label("quit") + ":quit",
+	}
+	return strings.Join(items, "  ")
+}
+
+// parseEscape returns name of a key from escape sequence without leading
+// Esc, like "[A" or "[1;5C". Returns error for unknown sequences.
+func parseEscape(seq string) (string, error) {
+	unknown := errors.New("unknown escape sequence")
+	if len(seq) < 2 {
+		return "", unknown
+	}
+	final := seq[len(seq)-1]
+	params := strings.Split(seq[1:len(seq)-1], ";")
+
+	var name string
+	switch {
+	case seq[0] == 'O' && len(seq) == 2:
+		name = map[byte]string{'A': "up", 'B': "down", 'C': "right",
+			'D': "left", 'H': "home", 'F': "end", 'P': "f1", 'Q': "f2",
+			'R': "f3", 'S': "f4"}[final]
+	case seq[0] == '[' && final == '~':
+		name = map[string]string{"1": "home", "2": "insert", "3": "delete",
+			"4": "end", "5": "pgup", "6": "pgdown", "7": "home", "8": "end",
+			"11": "f1", "12": "f2", "13": "f3", "14": "f4", "15": "f5",
+			"17": "f6", "18": "f7", "19": "f8", "20": "f9", "21": "f10",
+			"23": "f11", "24": "f12"}[params[0]]
+	case seq[0] == '[':
+		name = map[byte]string{'A': "up", 'B': "down", 'C': "right",
+			'D': "left", 'H': "home", 'F': "end", 'Z': "shift-tab",
+			'P': "f1", 'Q': "f2", 'R': "f3", 'S': "f4"}[final]
+	}
+	if name == "" {
+		return "", unknown
+	}
+
+	// xterm sends modifiers as the second parameter: 1 + shift(1) +
+	// alt(2) + ctrl(4)
+	if len(params) == 2 {
+		var mod int
+		fmt.Sscanf(params[1], "%d", &mod)
+		mod--
+		if mod&1 != 0 {
+			name = "shift-" + name
+		}
+		if mod&2 != 0 {
+			name = "alt-" + name
+		}
+		if mod&4 != 0 {
+			name = "ctrl-" + name
+		}
+	}
+	return name, nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// starredTag selects starred pronunciations when it is used as a tag filter
+const starredTag = "starred"
+
+// libraryEntry is a pronunciation starred or tagged by user
+type libraryEntry struct {
+	Word    string    `json:"word"`
+	Lang    string    `json:"lang"`
+	ID      string    `json:"id"`
+	Author  string    `json:"author"`
+	Sex     string    `json:"sex"`
+	Country string    `json:"country"`
+	Starred bool      `json:"starred,omitempty"`
+	Tags    []string  `json:"tags,omitempty"`
+	Added   time.Time `json:"added"`
+}
+
+// library is a local database of starred and tagged pronunciations kept in
+// a JSON file
+type library struct {
+	path    string
+	Entries []libraryEntry `json:"entries"`
+}
+
+// userLibrary is the library opened by openLibrary
+var userLibrary *library
+
+// loadLibrary reads library from a file. Missing file gives an empty
+// library, empty path gives a library which is not saved at all.
+func loadLibrary(path string) (*library, error) {
+	lib := &library{path: path}
+	if path == "" {
+		return lib, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return lib, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, lib); err != nil {
+		return nil, fmt.Errorf("broken library file %s: %v", path, err)
+	}
+	return lib, nil
+}
+
+// openLibrary returns the library set by cfg["LIBRARY"] loading it once
+func openLibrary(cfg Config) (*library, error) {
+	if userLibrary != nil && userLibrary.path == cfg["LIBRARY"] {
+		return userLibrary, nil
+	}
+	lib, err := loadLibrary(cfg["LIBRARY"])
+	if err != nil {
+		return nil, err
+	}
+	userLibrary = lib
+	return lib, nil
+}
+
+// save writes the library to its file
+func (l *library) save() error {
+	if l.path == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(l.path), 0750); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := l.path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.path)
+}
+
+// entry returns library entry of a pronunciation or nil if it is not in
+// the library
+func (l *library) entry(lang string, item Pron) *libraryEntry {
+	for i := range l.Entries {
+		e := &l.Entries[i]
+		if e.Lang == lang && e.ID == item.id {
+			return e
+		}
+	}
+	return nil
+}
+
+// add returns library entry of a pronunciation adding it if needed
+func (l *library) add(lang string, item Pron) *libraryEntry {
+	if e := l.entry(lang, item); e != nil {
+		return e
+	}
+	l.Entries = append(l.Entries, libraryEntry{
+		Word:    item.word,
+		Lang:    lang,
+		ID:      item.id,
+		Author:  item.author,
+		Sex:     item.sex,
+		Country: item.country,
+		Added:   time.Now(),
+	})
+	return &l.Entries[len(l.Entries)-1]
+}
+
+// toggleStar stars a pronunciation or removes the star. Returns true if the
+// pronunciation is starred now.
+func (l *library) toggleStar(lang string, item Pron) bool {
+	e := l.add(lang, item)
+	e.Starred = !e.Starred
+	return e.Starred
+}
+
+// tag adds tags to a pronunciation
+func (l *library) tag(lang string, item Pron, tags []string) {
+	e := l.add(lang, item)
+	for _, tag := range tags {
+		if !e.hasTag(tag) {
+			e.Tags = append(e.Tags, tag)
+		}
+	}
+}
+
+// hasTag checks if entry has a tag. Starred entries have starredTag.
+func (e *libraryEntry) hasTag(tag string) bool {
+	if tag == starredTag && e.Starred {
+		return true
+	}
+	for _, t := range e.Tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// taggedWords returns words of a language with a tagged pronunciation in
+// order they were added
+func (l *library) taggedWords(lang, tag string) []string {
+	var words []string
+	seen := make(map[string]bool)
+	for _, e := range l.Entries {
+		if e.Lang == lang && e.hasTag(tag) && !seen[e.Word] {
+			seen[e.Word] = true
+			words = append(words, e.Word)
+		}
+	}
+	return words
+}
+
+// filterTagged keeps only words with a pronunciation tagged with
+// cfg["TAG"]. Without words it returns all tagged words.
+func filterTagged(cfg Config, words []string) ([]string, error) {
+	lib, err := openLibrary(cfg)
+	if err != nil {
+		return nil, err
+	}
+	tagged := lib.taggedWords(cfg["LANG"], cfg["TAG"])
+	if len(words) == 0 {
+		return tagged, nil
+	}
+	isTagged := make(map[string]bool)
+	for _, word := range tagged {
+		isTagged[word] = true
+	}
+	var result []string
+	for _, word := range words {
+		if isTagged[word] {
+			result = append(result, word)
+		}
+	}
+	return result, nil
+}
+
+// taggedFirst moves pronunciations tagged with cfg["TAG"] to the beginning
+// of the list, so they are used by batches and exports
+func taggedFirst(cfg Config, list []Pron) []Pron {
+	if cfg["TAG"] == "" || len(list) < 2 {
+		return list
+	}
+	lib, err := openLibrary(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return list
+	}
+	var tagged, other []Pron
+	for _, item := range list {
+		if e := lib.entry(cfg["LANG"], item); e != nil && e.hasTag(cfg["TAG"]) {
+			tagged = append(tagged, item)
+		} else {
+			other = append(other, item)
+		}
+	}
+	return append(tagged, other...)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// lineEditor edits one line of text with keys returned by getChar. It
+// supports cursor movement, history and completion with Emacs-like keys.
+type lineEditor struct {
+	buf []rune
+	pos int
+	// history is a list of previous lines, the most recent first. recall
+	// is the shown history line or -1 for the edited one kept in draft.
+	history []string
+	recall  int
+	draft   []rune
+	// complete returns candidates for the text before cursor. Repeated Tab
+	// goes through matches keeping the text after cursor in rest.
+	complete func(prefix string) []string
+	matches  []string
+	match    int
+	rest     []rune
+}
+
+// newLineEditor returns an empty line editor
+func newLineEditor(history []string, complete func(prefix string) []string) *lineEditor {
+	return &lineEditor{history: history, recall: -1, complete: complete, match: -1}
+}
+
+// String returns the edited text
+func (ed *lineEditor) String() string {
+	return string(ed.buf)
+}
+
+// cursor returns column of the cursor. Combining marks do not take a column.
+func (ed *lineEditor) cursor() int {
+	col := 0
+	for _, r := range ed.buf[:ed.pos] {
+		if !unicode.Is(unicode.Mn, r) {
+			col++
+		}
+	}
+	return col
+}
+
+// handle changes the line according to a key. Returns done if user has
+// finished the line with Enter and cancel if user has canceled the input.
+func (ed *lineEditor) handle(key string) (done, cancel bool) {
+	name := keyName(key)
+	if name != "tab" {
+		ed.matches, ed.match = nil, -1
+	}
+	switch name {
+	case "enter":
+		return len(ed.buf) > 0, false
+	case "esc", "ctrl-c", "ctrl-g":
+		return false, true
+	case "left", "ctrl-b":
+		ed.pos = ed.prevChar(ed.pos)
+	case "right", "ctrl-f":
+		ed.pos = ed.nextChar(ed.pos)
+	case "home", "ctrl-a":
+		ed.pos = 0
+	case "end", "ctrl-e":
+		ed.pos = len(ed.buf)
+	case "ctrl-left", "alt-b":
+		ed.pos = ed.prevWord(ed.pos)
+	case "ctrl-right", "alt-f":
+		ed.pos = ed.nextWord(ed.pos)
+	case "backspace":
+		ed.delete(ed.prevChar(ed.pos), ed.pos)
+	case "delete", "ctrl-d":
+		ed.delete(ed.pos, ed.nextChar(ed.pos))
+	case "ctrl-w", "alt-backspace":
+		ed.delete(ed.prevWord(ed.pos), ed.pos)
+	case "alt-d":
+		ed.delete(ed.pos, ed.nextWord(ed.pos))
+	case "ctrl-u":
+		ed.delete(0, ed.pos)
+	case "ctrl-k":
+		ed.delete(ed.pos, len(ed.buf))
+	case "up", "ctrl-p":
+		ed.recallLine(ed.recall + 1)
+	case "down", "ctrl-n":
+		ed.recallLine(ed.recall - 1)
+	case "tab":
+		ed.completeLine()
+	default:
+		r, size := utf8.DecodeRuneInString(key)
+		if size == len(key) && unicode.IsPrint(r) {
+			ed.insert([]rune(key))
+		}
+	}
+	return false, false
+}
+
+// insert puts text at the cursor
+func (ed *lineEditor) insert(text []rune) {
+	buf := append([]rune{}, ed.buf[:ed.pos]...)
+	buf = append(buf, text...)
+	ed.buf = append(buf, ed.buf[ed.pos:]...)
+	ed.pos += len(text)
+}
+
+// delete removes runes from start to end and moves the cursor to start
+func (ed *lineEditor) delete(start, end int) {
+	if start >= end {
+		return
+	}
+	ed.buf = append(ed.buf[:start], ed.buf[end:]...)
+	ed.pos = start
+}
+
+// prevChar returns position of the character before pos. Combining marks
+// belong to the character before them.
+func (ed *lineEditor) prevChar(pos int) int {
+	if pos == 0 {
+		return 0
+	}
+	pos--
+	for pos > 0 && unicode.Is(unicode.Mn, ed.buf[pos]) {
+		pos--
+	}
+	return pos
+}
+
+// nextChar returns position after the character at pos
+func (ed *lineEditor) nextChar(pos int) int {
+	if pos == len(ed.buf) {
+		return pos
+	}
+	pos++
+	for pos < len(ed.buf) && unicode.Is(unicode.Mn, ed.buf[pos]) {
+		pos++
+	}
+	return pos
+}
+
+// prevWord returns position of the beginning of the word before pos
+func (ed *lineEditor) prevWord(pos int) int {
+	for pos > 0 && !isWordRune(ed.buf[pos-1]) {
+		pos--
+	}
+	for pos > 0 && isWordRune(ed.buf[pos-1]) {
+		pos--
+	}
+	return pos
+}
+
+// nextWord returns position of the end of the word after pos
+func (ed *lineEditor) nextWord(pos int) int {
+	for pos < len(ed.buf) && !isWordRune(ed.buf[pos]) {
+		pos++
+	}
+	for pos < len(ed.buf) && isWordRune(ed.buf[pos]) {
+		pos++
+	}
+	return pos
+}
+
+// isWordRune checks if a rune is a part of a word
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r)
+}
+
+// recallLine shows a line from history. The edited line is kept and comes
+// back after the most recent history line.
+func (ed *lineEditor) recallLine(idx int) {
+	if idx < -1 || idx >= len(ed.history) || idx == ed.recall {
+		return
+	}
+	if ed.recall == -1 {
+		ed.draft = ed.buf
+	}
+	ed.recall = idx
+	if idx == -1 {
+		ed.buf = ed.draft
+	} else {
+		ed.buf = []rune(ed.history[idx])
+	}
+	ed.pos = len(ed.buf)
+}
+
+// completeLine completes text before the cursor to the longest common
+// beginning of matches. If it is already complete, repeated Tab goes
+// through the matches.
+func (ed *lineEditor) completeLine() {
+	if ed.matches == nil {
+		if ed.complete == nil {
+			return
+		}
+		ed.matches = ed.complete(string(ed.buf[:ed.pos]))
+		ed.rest = append([]rune{}, ed.buf[ed.pos:]...)
+		if len(ed.matches) == 0 {
+			return
+		}
+		if common := commonPrefix(ed.matches); len([]rune(common)) > ed.pos {
+			ed.setCompletion(common)
+			return
+		}
+	}
+	if len(ed.matches) == 0 {
+		return
+	}
+	ed.match = (ed.match + 1) % len(ed.matches)
+	if ed.matches[ed.match] == string(ed.buf[:ed.pos]) && len(ed.matches) > 1 {
+		ed.match = (ed.match + 1) % len(ed.matches)
+	}
+	ed.setCompletion(ed.matches[ed.match])
+}
+
+// setCompletion replaces text before the cursor with a completion
+func (ed *lineEditor) setCompletion(text string) {
+	ed.buf = append([]rune(text), ed.rest...)
+	ed.pos = len(ed.buf) - len(ed.rest)
+}
+
+// commonPrefix returns the longest common beginning of words. Case of the
+// first word is used.
+func commonPrefix(words []string) string {
+	prefix := []rune(words[0])
+	for _, word := range words[1:] {
+		runes := []rune(strings.ToLower(word))
+		n := 0
+		for n < len(prefix) && n < len(runes) &&
+			unicode.ToLower(prefix[n]) == runes[n] {
+			n++
+		}
+		prefix = prefix[:n]
+	}
+	return string(prefix)
+}
+
+// completeWord returns words starting with prefix ignoring case without
+// repeats
+func completeWord(words []string, prefix string) []string {
+	var result []string
+	seen := make(map[string]bool)
+	for _, word := range words {
+		if !seen[word] &&
+			strings.HasPrefix(strings.ToLower(word), strings.ToLower(prefix)) {
+			seen[word] = true
+			result = append(result, word)
+		}
+	}
+	return result
+}
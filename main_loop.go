@@ -2,7 +2,6 @@ package main
 
 import (
 	"bufio"
-	"crypto/md5"
 	"encoding/base64"
 	"errors"
 	"fmt"
@@ -10,7 +9,6 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
-	"strconv"
 	"strings"
 )
 
@@ -18,7 +16,7 @@ const forvoURL = "https://forvo.com"
 const audioURL = "https://audio00.forvo.com/audios"
 
 type Pron struct {
-	word, author, sex, country, mp3, ogg, aFile, aURL, fullAuthor, cacheDir,
+	word, id, author, sex, country, mp3, ogg, aFile, aURL, fullAuthor, cacheDir,
 	cacheFile string
 }
 
@@ -32,29 +30,34 @@ func mainLoop(cfg Config, args []string) {
 	getHTML = getURL
 	getAudio = downloadFile
 
-	tmpDir, err := ioutil.TempDir("", "tellme")
+	var err error
+	tmpDir, err = ioutil.TempDir("", "tellme")
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 	defer os.RemoveAll(tmpDir)
 
+	if cfg["TAG"] != "" {
+		args = readWords(cfg, args)
+		if len(args) == 0 {
+			fmt.Fprintf(os.Stderr, "no words tagged with '%s'\n", cfg["TAG"])
+			os.Exit(1)
+		}
+	}
+
 	if cfg["INTERACTIVE"] == "no" {
 		if len(args) > 0 {
 			loopNonInArgs(cfg, args)
+		} else if cfg["RECENT"] == "yes" {
+			loopNonInHistory(cfg)
 		} else if cfg["FILE"] != "" {
 			loopNonInFile(cfg)
 		} else {
 			loopNonInStdin(cfg)
 		}
 	} else if cfg["INTERACTIVE"] == "yes" {
-		if len(args) > 0 {
-			loopInArgs(cfg, args)
-		} else if cfg["FILE"] != "" {
-			loopInFile(cfg)
-		} else {
-			loopInStdin(cfg)
-		}
+		runTUI(cfg, args)
 	}
 	return
 }
@@ -66,13 +69,21 @@ func loopNonInArgs(cfg Config, args []string) {
 		if word == "" {
 			continue
 		}
-		list := getPronList(cfg, word)
-		if len(list) > 0 {
-			saveWord(cfg, list[0])
-		}
+		lookupWord(cfg, word)
 	}
 }
 
+// loopNonInHistory is loop for non-interactive processing of words from
+// history
+func loopNonInHistory(cfg Config) {
+	words, err := historyWords(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	loopNonInArgs(cfg, words)
+}
+
 // loopNonInFile is loop for non-interactive processing with getting words from
 // the file
 func loopNonInFile(cfg Config) {
@@ -89,10 +100,7 @@ func loopNonInFile(cfg Config) {
 		if word == "" {
 			continue
 		}
-		list := getPronList(cfg, word)
-		if len(list) > 0 {
-			saveWord(cfg, list[0])
-		}
+		lookupWord(cfg, word)
 	}
 
 	if err := scanner.Err(); err != nil {
@@ -110,10 +118,7 @@ func loopNonInStdin(cfg Config) {
 		if word == "" {
 			continue
 		}
-		list := getPronList(cfg, word)
-		if len(list) > 0 {
-			saveWord(cfg, list[0])
-		}
+		lookupWord(cfg, word)
 	}
 
 	if err := scanner.Err(); err != nil {
@@ -122,358 +127,115 @@ func loopNonInStdin(cfg Config) {
 	}
 }
 
-// loopInArgs is loop for interactive processing with getting words from
-// argument list
-func loopInArgs(cfg Config, args []string) {
-	var words []string
-	for i := 0; i < len(args); i++ {
-		if args[i] != "" {
-			words = append(words, args[i])
-		}
-	}
-	if len(words) == 0 {
-		return
-	}
-
-	wordIdx := 0
-	pronIdx := 0
-	var key string
-	for {
-		list := getPronList(cfg, words[wordIdx])
-		if len(list) == 0 {
-			key = printNoPron(words[wordIdx], wordIdx == 0, wordIdx == len(words)-1)
-		} else {
-			key = printMenu(cfg, list, pronIdx, wordIdx == 0, wordIdx == len(words)-1)
-		}
-		switch key {
-		case "q":
-			return
-		case "p":
-			wordIdx--
-			pronIdx = 0
-		case "n", "\n":
-			wordIdx++
-			pronIdx = 0
-		case "r":
-		case "j":
-			pronIdx++
-		case "k":
-			pronIdx--
-		case "t":
-		case "e":
-			newWord := getNewWord()
-			words = append(words[:wordIdx+1], words[wordIdx:]...)
-			words[wordIdx] = newWord
-			pronIdx = 0
-		default:
-			pronIdx, _ = strconv.Atoi(key)
-		}
-	}
-}
-
-// loopInFile is loop for interactive processing with getting words from
-// the file
-func loopInFile(cfg Config) {
-	var words []string
-	file, err := os.Open(cfg["FILE"])
-	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
-	}
-	defer file.Close()
-
-	scanner := bufio.NewScanner(file)
-
-	wordIdx := 0
-	pronIdx := 0
-	eof := false
-	var key string
-	for {
-		// read a new word
-		if wordIdx == len(words) && !eof {
-			if scanner.Scan() {
-				newWord := scanner.Text()
-				if newWord == "" {
-					continue
-				}
-				words = append(words, newWord)
-				wordIdx = len(words) - 1
-				pronIdx = 0
-			} else if err := scanner.Err(); err != nil {
-				fmt.Fprintln(os.Stderr, err)
-				os.Exit(1)
-			} else {
-				wordIdx = len(words) - 1
-				eof = true
-			}
-		}
-		list := getPronList(cfg, words[wordIdx])
-		if len(list) == 0 {
-			key = printNoPron(words[wordIdx], wordIdx == 0, wordIdx == len(words)-1 && eof)
-		} else {
-			key = printMenu(cfg, list, pronIdx, wordIdx == 0, wordIdx == len(words)-1 && eof)
-		}
-		switch key {
-		case "q":
-			return
-		case "p":
-			wordIdx--
-			pronIdx = 0
-		case "n", "\n":
-			wordIdx++
-			pronIdx = 0
-		case "r":
-		case "j":
-			pronIdx++
-		case "k":
-			pronIdx--
-		case "t":
-		case "e":
-			newWord := getNewWord()
-			words = append(words[:wordIdx+1], words[wordIdx:]...)
-			words[wordIdx] = newWord
-			pronIdx = 0
-		default:
-			pronIdx, _ = strconv.Atoi(key)
-		}
-	}
-}
-
-// loopInStdin is loop for interactive processing with getting words from
-// standart input
-func loopInStdin(cfg Config) {
-	var words []string
-	wordIdx := 0
-	pronIdx := 0
-	var key string
-
-	newWord := getNewWord()
-	words = append(words, newWord)
-	for {
-		list := getPronList(cfg, words[wordIdx])
-		if len(list) == 0 {
-			key = printNoPron(words[wordIdx], wordIdx == 0, wordIdx == len(words)-1)
-		} else {
-			key = printMenu(cfg, list, pronIdx, wordIdx == 0, wordIdx == len(words)-1)
-		}
-		switch key {
-		case "q":
-			return
-		case "p":
-			wordIdx--
-			pronIdx = 0
-		case "n", "\n":
-			wordIdx++
-			pronIdx = 0
-		case "r":
-		case "j":
-			pronIdx++
-		case "k":
-			pronIdx--
-		case "t":
-		case "e":
-			newWord := getNewWord()
-			words = append(words[:wordIdx+1], words[wordIdx:]...)
-			words[wordIdx] = newWord
-			pronIdx = 0
-		default:
-			pronIdx, _ = strconv.Atoi(key)
-		}
-	}
-}
-
-// getNewWord shows promt for user and returns entered word
-func getNewWord() string {
-	scanner := bufio.NewScanner(os.Stdin)
-	fmt.Print("Enter a new word: ")
-	for scanner.Scan() {
-		word := scanner.Text()
-		if word == "" {
-			fmt.Print("Enter a new word: ")
-			continue
+// lookupWord saves the best pronunciation of a word and records the word in
+// history
+func lookupWord(cfg Config, word string) {
+	var item Pron
+	list := getPronList(cfg, word)
+	if len(list) > 0 {
+		item = list[0]
+		if _, err := saveWord(cfg, item); err != nil {
+			fmt.Fprintln(os.Stderr, err)
 		}
-		return word
 	}
-
-	if err := scanner.Err(); err != nil {
+	if err := addHistory(cfg, word, item); err != nil {
 		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
 	}
-	return ""
 }
 
-// printNoPron handles case if we can not find pronunciations for this word.
-// Could be be some network issues. In this case you can retray
-func printNoPron(word string, isFirstWord, isLastWord bool) string {
-	optLine := fmt.Sprintf("Can not get pronunciation for `%s`\n\n", word)
-	allowedChars := "tqe"
-	if !isLastWord {
-		optLine += "[n|<Enter>]:next word    "
-		allowedChars += "n\n"
-	}
-	if !isFirstWord {
-		optLine += "[p]:previous word    "
-		allowedChars += "p"
-	}
-	optLine += "[t]:try again    [e]:enter a new word    [q]:quit\n"
-
-	clearScreen()
-	fmt.Println(word)
-	fmt.Println(strings.Repeat("=", len(word)))
-	fmt.Print(optLine)
-
-	for {
-		char := getChar()
-		if strings.Index(allowedChars, char) == -1 {
-			continue
-		}
-		return char
-	}
-}
-
-// printMenu outputs list of pronunciations and handles user input. Return
-// one of allowed keys
-func printMenu(cfg Config, list []Pron, pronIdx int, isFirstWord, isLastWord bool) string {
-	// format list of pronunciations
-	word := list[0].word
-	pronLines := word + "\n"
-	pronLines += fmt.Sprintln(strings.Repeat("=", len(word)))
-	digitsNum := len(strconv.Itoa(len(list)))
-	for i, item := range list {
-		star := " "
-		if i == pronIdx {
-			star = "*"
-		}
-		pronLines += fmt.Sprintf("%s %0"+strconv.Itoa(digitsNum)+"d\tBy %s\n",
-			star, i, item.fullAuthor)
-	}
-	pronLines += "\n"
-
-	// format user help status bar
-	optLine := ""
-	allowedChars := "erq"
-	if len(list) != 1 {
-		optLine += fmt.Sprintf("[0-%d]:choose pronunciation    ", len(list)-1)
-		allowedChars += "1234567890"
-	}
-	if pronIdx != len(list)-1 {
-		optLine += "[j]:next pronunciation    "
-		allowedChars += "j"
-	}
-	if pronIdx != 0 {
-		optLine += "[k]:previous pronunciation    "
-		allowedChars += "k"
-	}
-	optLine += "[r]:replay sound    "
-
-	if !isLastWord {
-		optLine += "[n|<Enter>]:next word    "
-		allowedChars += "n\n"
-	}
-	if !isFirstWord {
-		optLine += "[p]:previous word    "
-		allowedChars += "p"
-	}
-	optLine += "[e]:enter a new word    [q]:quit\n"
-
-	alreadySaid := false
-UPDATE_PRINT:
-	clearScreen()
-	fmt.Print(pronLines)
-	fmt.Print(optLine)
-
-	// play pronunciation audio file
-	if !alreadySaid {
-		aPath := saveWord(cfg, list[pronIdx])
-		sayWord(aPath)
-		alreadySaid = true
-	}
-
-	// handle user input
-	var choosenItem string
-	for {
-		char := getChar()
-		if strings.Index(allowedChars, char) == -1 {
-			continue
-		}
-		_, err := strconv.Atoi(char)
-		if err == nil {
-			choosenItem += char
-			fmt.Print(char)
-			num, _ := strconv.Atoi(choosenItem)
-			if num > len(list)-1 {
-				fmt.Println("\nNumber you entered is too big. Press any key...")
-				getChar()
-				goto UPDATE_PRINT
-			}
-			if len(choosenItem) == digitsNum {
-				return choosenItem
-			}
-			continue
-		}
-		return char
-	}
-}
-
-// saveWord saves mp3/ogg file in cache and in current directory. If cache
-// enabled and file already in it returns the word from the cache
-func saveWord(cfg Config, item Pron) string {
+// saveWord saves mp3/ogg file in cache and in current directory converting it
+// to the output format. If cache enabled and file already in it returns the
+// word from the cache. If the file is cached but can not be exported, the
+// cached file is returned with the error.
+func saveWord(cfg Config, item Pron) (string, error) {
 	if cfg["VERBOSE"] == "yes" {
 		fmt.Printf("Saving audio file: `%s`\n", item.aFile)
 	}
 
 	if cfg["CACHE"] == "yes" {
-		_, err := os.Stat(item.cacheFile)
-		if errors.Is(err, os.ErrNotExist) {
-			err = getAudio(cfg, item.aURL, item.cacheFile)
-			if err != nil {
-				return ""
-			}
+		_, err := cacheAudio(cfg, item)
+		if err != nil {
+			return "", err
 		}
 
 		if cfg["DOWNLOAD"] == "yes" {
-			copyFile(cfg, item.cacheFile, item.aFile)
-			return item.aFile
+			if err = exportAudio(cfg, item, item.cacheFile); err != nil {
+				return item.cacheFile, err
+			}
+			return item.aFile, nil
 		}
-		return item.cacheFile
+		return item.cacheFile, nil
 	}
 
 	// we do not use cache
 	if cfg["DOWNLOAD"] == "yes" {
-		err := getAudio(cfg, item.aURL, item.aFile)
+		if outputFormat(cfg) == cfg["ATYPE"] && !processingEnabled(cfg) {
+			err := getAudio(cfg, item.aURL, item.aFile)
+			if err != nil {
+				return "", err
+			}
+			if err = tagAudio(cfg, item, item.aFile); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			return item.aFile, nil
+		}
+
+		// download to a private temporary directory and process it there
+		dir, err := os.MkdirTemp("", "tellme")
 		if err != nil {
-			return ""
+			return "", err
+		}
+		defer os.RemoveAll(dir)
+		file := filepath.Join(dir, filepath.Base(item.cacheFile))
+		if err = getAudio(cfg, item.aURL, file); err != nil {
+			return "", err
+		}
+		if err = exportAudio(cfg, item, file); err != nil {
+			return "", err
 		}
+		return item.aFile, nil
 	}
 
 	// We have no cache and do not save file in local directory.
 	// So we use temporary file if we are in interactive mode.
 	// Otherwise we just do not need download anything
 	if cfg["INTERACTIVE"] == "yes" {
-		file := filepath.Join(tmpDir + filepath.Base(item.cacheFile))
+		file := filepath.Join(tmpDir, filepath.Base(item.cacheFile))
 		err := getAudio(cfg, item.aURL, file)
 		if err != nil {
-			return ""
+			return "", err
 		}
-		return file
+		return file, nil
 	}
 
-	return ""
+	return "", nil
+}
+
+// playableFile saves a pronunciation and returns the file to play. The cached
+// file is preferred to the exported one, which may be in a format the player
+// can not decode.
+func playableFile(cfg Config, item Pron) (string, error) {
+	path, err := saveWord(cfg, item)
+	if path != "" && cfg["CACHE"] == "yes" {
+		return item.cacheFile, err
+	}
+	return path, err
 }
 
 // pronCheck makes a seach request to be sure pronunciation for this word
 // exists. I does not matter in case just one word, but if we have list of a few
-// hundreds I am afraid we can be block by some anti-bot system
-func pronCheck(cfg Config, word string) bool {
+// hundreds I am afraid we can be block by some anti-bot system. The search
+// page is returned too, so suggestions for the word do not fetch it again.
+func pronCheck(cfg Config, word string) (bool, string) {
 	if cfg["VERBOSE"] == "yes" {
 		fmt.Printf("Checking pronunciation existing: `%s`\n", word)
 	}
 
-	pageURL := fmt.Sprintf("%s/search/%s/%s/", forvoURL, word, cfg["LANG"])
+	pageURL := searchURL(cfg, word)
 	pageText, err := getHTML(cfg, pageURL)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "can not get search page for '%s'!\n", word)
-		return false
+		return false, ""
 	}
 
 	// extract block with count of founded words
@@ -482,20 +244,48 @@ func pronCheck(cfg Config, word string) bool {
 	countRe := regexp.MustCompile(countStr)
 	count := countRe.FindStringSubmatch(pageText)
 	if count == nil || count[1] == "0 words found" {
-		return false
+		return false, pageText
 	}
 
-	return true
+	return true, pageText
+}
+
+// searchURL returns URL of the Forvo search page of a word
+func searchURL(cfg Config, word string) string {
+	return fmt.Sprintf("%s/search/%s/%s/", forvoURL, word, cfg["LANG"])
 }
 
 // getPronList gets a pronunciation list for a specific word
-func getPronList(cfg Config, word string) (result []Pron) {
+func getPronList(cfg Config, word string) []Pron {
+	list, _ := getPronListPage(cfg, word)
+	return list
+}
+
+// getPronListPage gets a pronunciation list for a word and the search page if
+// it was fetched to check the word
+func getPronListPage(cfg Config, word string) (result []Pron, searchPage string) {
 	if cfg["VERBOSE"] == "yes" {
 		fmt.Printf("Extracting pronunciation list for `%s`\n", word)
 	}
 
+	// pronunciations chosen by user go first and broken ones go last in
+	// batch mode
+	defer func() {
+		if cfg["INTERACTIVE"] != "yes" {
+			result = demoteBroken(cfg, result)
+		}
+		result = taggedFirst(cfg, result)
+	}()
+
+	if cfg["CACHE"] == "yes" {
+		if result = cachedPronList(cfg, word); result != nil {
+			return
+		}
+	}
+
 	if cfg["PRONUNCIATION_CHECK"] == "yes" {
-		if !pronCheck(cfg, word) {
+		var found bool
+		if found, searchPage = pronCheck(cfg, word); !found {
 			fmt.Fprintf(os.Stderr, "no pronunciations for '%s'!\n", word)
 			return
 		}
@@ -527,40 +317,65 @@ func getPronList(cfg Config, word string) (result []Pron) {
 		return
 	}
 	for _, chunk := range pronBlocks {
-		result = append(result, extractItem(cfg, word, chunk))
+		item, err := extractItem(cfg, word, chunk)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			continue
+		}
+		result = append(result, item)
+	}
+
+	if cfg["CACHE"] == "yes" {
+		if err := writeIndex(cfg, word, result); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
 	}
 
 	return
 }
 
 // extractItem extracts all needed data from one <li> tag
-func extractItem(cfg Config, word, chunk string) Pron {
-	var item Pron
-	item.word = word
-
+func extractItem(cfg Config, word, chunk string) (Pron, error) {
 	chunkStr := `(?is)onclick="Play\(\d+,.*?,.*?,.*?,'(.*?)'.*?>\s*` +
 		`Pronunciation by\s*(.*?)\s*` +
 		`</span>\s*<span class="from">\((.*?)(?:\ from\ (.*?))?\)</span>`
 	chunkRe := regexp.MustCompile(chunkStr)
 	items := chunkRe.FindStringSubmatch(chunk)
 	if items == nil {
-		fmt.Fprintln(os.Stderr, "can not extract items from pronunciation block")
-		os.Exit(1)
+		return Pron{}, errors.New("can not extract items from pronunciation block")
 	}
 
+	// audio path is the stable identifier of the recording
 	encodedMp3 := items[1]
 	decodedMp3, err := base64.StdEncoding.DecodeString(encodedMp3)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		return Pron{}, err
 	}
-	mp3String := string(decodedMp3)
-	newLine := strings.LastIndex(mp3String, ".")
+	id := strings.TrimSpace(string(decodedMp3))
+	newLine := strings.LastIndex(id, ".")
 	if newLine > -1 {
-		mp3String = mp3String[:newLine]
+		id = id[:newLine]
 	}
-	item.mp3 = audioURL + "/mp3/" + mp3String + ".mp3"
-	item.ogg = audioURL + "/ogg/" + mp3String + ".ogg"
+
+	author := items[2]
+	authorRe := regexp.MustCompile(`(?si)^<span\ class="ofLink".*?>(.*?)</span>`)
+	cleanedAuthor := authorRe.FindStringSubmatch(author)
+	if len(cleanedAuthor) > 0 {
+		author = cleanedAuthor[1]
+	}
+
+	return newPron(cfg, word, id, author, items[3], items[4]), nil
+}
+
+// newPron fills all fields of a pronunciation from its audio id and metadata
+func newPron(cfg Config, word, id, author, sex, country string) Pron {
+	var item Pron
+	item.word = word
+	item.id = id
+	item.author = author
+
+	item.mp3 = audioURL + "/mp3/" + id + ".mp3"
+	item.ogg = audioURL + "/ogg/" + id + ".ogg"
 
 	switch cfg["ATYPE"] {
 	case "mp3":
@@ -569,15 +384,8 @@ func extractItem(cfg Config, word, chunk string) Pron {
 		item.aURL = item.ogg
 	}
 
-	item.author = items[2]
-	authorRe := regexp.MustCompile(`(?si)^<span\ class="ofLink".*?>(.*?)</span>`)
-	cleanedAuthor := authorRe.FindStringSubmatch(item.author)
-	if len(cleanedAuthor) > 0 {
-		item.author = cleanedAuthor[1]
-	}
-
-	item.sex = strings.ToLower(items[3])
-	item.country = items[4]
+	item.sex = strings.ToLower(sex)
+	item.country = country
 	if len(item.country) == 0 {
 		item.country = "Unknown"
 	}
@@ -585,14 +393,9 @@ func extractItem(cfg Config, word, chunk string) Pron {
 	item.fullAuthor = fmt.Sprintf("%s (%s from %s)",
 		item.author, item.sex, item.country)
 
-	hash := fmt.Sprintf("%x", md5.Sum([]byte(word)))[0:2]
-	item.cacheDir = filepath.Join(cfg["CACHE_DIR"], cfg["ATYPE"],
-		cfg["LANG"], hash)
-
-	item.cacheFile = filepath.Join(item.cacheDir,
-		word+"_"+item.author+"."+cfg["ATYPE"])
+	item.cacheDir, item.cacheFile = audioCachePath(cfg, cfg["ATYPE"], id)
 
-	item.aFile = word + "." + cfg["ATYPE"]
+	item.aFile = word + "." + outputFormat(cfg)
 
 	return item
 }
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+type oggPage struct {
+	headerType byte
+	granule    uint64
+	serial     uint32
+	seq        uint32
+	segments   []byte
+	body       []byte
+}
+
+var oggCRCTable = func() (table [256]uint32) {
+	for i := range table {
+		r := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if r&0x80000000 != 0 {
+				r = r<<1 ^ 0x04c11db7
+			} else {
+				r <<= 1
+			}
+		}
+		table[i] = r
+	}
+	return
+}()
+
+// oggCRC calculates checksum of an ogg page
+func oggCRC(data []byte) uint32 {
+	var crc uint32
+	for _, b := range data {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^b]
+	}
+	return crc
+}
+
+// readOggPages splits ogg data into pages
+func readOggPages(data []byte) ([]oggPage, error) {
+	var pages []oggPage
+	for pos := 0; pos < len(data); {
+		if pos+27 > len(data) || string(data[pos:pos+4]) != "OggS" {
+			return nil, errors.New("broken ogg page")
+		}
+		nsegs := int(data[pos+26])
+		if pos+27+nsegs > len(data) {
+			return nil, errors.New("broken ogg page")
+		}
+		page := oggPage{
+			headerType: data[pos+5],
+			granule:    binary.LittleEndian.Uint64(data[pos+6:]),
+			serial:     binary.LittleEndian.Uint32(data[pos+14:]),
+			seq:        binary.LittleEndian.Uint32(data[pos+18:]),
+			segments:   data[pos+27 : pos+27+nsegs],
+		}
+		size := 0
+		for _, s := range page.segments {
+			size += int(s)
+		}
+		start := pos + 27 + nsegs
+		if start+size > len(data) {
+			return nil, errors.New("broken ogg page")
+		}
+		page.body = data[start : start+size]
+		pages = append(pages, page)
+		pos = start + size
+	}
+	return pages, nil
+}
+
+// encode returns binary representation of the page with a valid checksum
+func (p oggPage) encode() []byte {
+	data := make([]byte, 27, 27+len(p.segments)+len(p.body))
+	copy(data, "OggS")
+	data[5] = p.headerType
+	binary.LittleEndian.PutUint64(data[6:], p.granule)
+	binary.LittleEndian.PutUint32(data[14:], p.serial)
+	binary.LittleEndian.PutUint32(data[18:], p.seq)
+	data[26] = byte(len(p.segments))
+	data = append(data, p.segments...)
+	data = append(data, p.body...)
+	binary.LittleEndian.PutUint32(data[22:], oggCRC(data))
+	return data
+}
+
+// oggPacketPages lays out packets into pages of a logical stream starting
+// with sequence number seq
+func oggPacketPages(serial, seq uint32, packets [][]byte) []oggPage {
+	var pages []oggPage
+	page := oggPage{serial: serial, seq: seq}
+	for _, packet := range packets {
+		for pos := 0; ; pos += 255 {
+			if len(page.segments) == 255 {
+				pages = append(pages, page)
+				seq++
+				page = oggPage{serial: serial, seq: seq}
+				if pos > 0 {
+					page.headerType = 1 // continued packet
+				}
+			}
+			size := len(packet) - pos
+			if size > 255 {
+				size = 255
+			}
+			page.segments = append(page.segments, byte(size))
+			page.body = append(page.body, packet[pos:pos+size]...)
+			if size < 255 {
+				break
+			}
+		}
+	}
+	if len(page.segments) > 0 {
+		pages = append(pages, page)
+	}
+	return pages
+}
+
+// writeOggComments replaces comment header of the first logical stream of
+// ogg Vorbis or Opus data
+func writeOggComments(data []byte, tags audioTags) ([]byte, error) {
+	pages, err := readOggPages(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(pages) == 0 {
+		return nil, errors.New("empty ogg file")
+	}
+
+	// collect header packets
+	serial := pages[0].serial
+	var packets [][]byte
+	var packet []byte
+	headers := 0
+	last := 0
+	for i, page := range pages {
+		if page.serial != serial {
+			return nil, errors.New("multiplexed ogg streams are not supported")
+		}
+		pos := 0
+		for _, s := range page.segments {
+			packet = append(packet, page.body[pos:pos+int(s)]...)
+			pos += int(s)
+			if s < 255 {
+				packets = append(packets, packet)
+				packet = nil
+			}
+		}
+		if i == 0 && (len(packets) != 1 || packet != nil) {
+			return nil, errors.New("first ogg page has to hold only one packet")
+		}
+		if headers == 0 {
+			switch {
+			case bytes.HasPrefix(packets[0], []byte("\x01vorbis")):
+				headers = 3
+			case bytes.HasPrefix(packets[0], []byte("OpusHead")):
+				headers = 2
+			default:
+				return nil, errors.New("unsupported ogg codec")
+			}
+		}
+		if headers > 0 && len(packets) >= headers {
+			if len(packets) > headers || packet != nil {
+				return nil, errors.New("audio data on header page")
+			}
+			last = i
+			break
+		}
+	}
+	if headers == 0 || len(packets) < headers {
+		return nil, errors.New("ogg headers are missing")
+	}
+
+	var vendor string
+	var comments []string
+	if headers == 3 {
+		if !bytes.HasPrefix(packets[1], []byte("\x03vorbis")) {
+			return nil, errors.New("vorbis comment header is missing")
+		}
+		vendor, comments, err = parseVorbisComment(packets[1][7:])
+		if err != nil {
+			return nil, err
+		}
+		packets[1] = append([]byte("\x03vorbis"),
+			encodeVorbisComment(vendor, comments, tags)...)
+		packets[1] = append(packets[1], 1) // framing bit
+	} else {
+		if !bytes.HasPrefix(packets[1], []byte("OpusTags")) {
+			return nil, errors.New("opus tags header is missing")
+		}
+		vendor, comments, err = parseVorbisComment(packets[1][8:])
+		if err != nil {
+			return nil, err
+		}
+		packets[1] = append([]byte("OpusTags"),
+			encodeVorbisComment(vendor, comments, tags)...)
+	}
+
+	// the first page holds only the identification header
+	var buf bytes.Buffer
+	buf.Write(pages[0].encode())
+	newPages := oggPacketPages(serial, pages[0].seq+1, packets[1:])
+	for _, page := range newPages {
+		buf.Write(page.encode())
+	}
+	// renumber the rest of pages of the stream
+	shift := uint32(len(newPages)) - (pages[last].seq - pages[0].seq)
+	for _, page := range pages[last+1:] {
+		if page.serial == serial {
+			page.seq += shift
+		}
+		buf.Write(page.encode())
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jfreymuth/pulse"
+)
+
+const minSpeed = 0.5
+const maxSpeed = 2.0
+const speedStep = 0.1
+
+type playerPreset struct {
+	command string
+	formats []string
+	speed   bool
+}
+
+// playerPresets are known players which can be set by name in PLAYER.
+// Presets without speed support can not change tempo of playback.
+var playerPresets = map[string]playerPreset{
+	"mpg123": {"mpg123 -q {file}", []string{"mp3"}, false},
+	"mpv":    {"mpv --really-quiet --no-video --speed={speed} {file}", nil, true},
+	"ffplay": {"ffplay -nodisp -autoexit -loglevel quiet -af atempo={speed} {file}", nil, true},
+	"paplay": {"paplay {file}", nil, false},
+	"play":   {"play -q {file} tempo {speed}", nil, true},
+}
+
+// playback is a pronunciation played in background
+type playback struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// playbackError reports errors of background playback
+var playbackError = func(err error) {
+	// terminal can be in raw mode, so return carriage explicitly
+	fmt.Fprintf(os.Stderr, "\r%v\r\n", err)
+}
+
+// sayWord plays audiofile with pronunciation cfg["REPEAT"] times using player
+// set in cfg["PLAYER"] or in cfg["PLAYER_<FORMAT>"] for this type of files
+func sayWord(cfg Config, path string) error {
+	return playWord(context.Background(), cfg, path)
+}
+
+// sequenceGap is a pause between files played in sequence
+const sequenceGap = 400 * time.Millisecond
+
+// startPlayback plays audio file in background, so user can press keys
+// meanwhile. Playback errors are reported as soon as they happen.
+func startPlayback(cfg Config, path string) *playback {
+	return startSequence(cfg, []string{path}, nil)
+}
+
+// startSequence plays audio files one after another in background. Unless
+// playback is stopped, started is called with index of every file before it
+// is played and with number of files after the last one.
+func startSequence(cfg Config, paths []string, started func(i int)) *playback {
+	// the config can be changed while we are playing
+	playCfg := make(Config)
+	for k, v := range cfg {
+		playCfg[k] = v
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &playback{cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(p.done)
+		for i, path := range paths {
+			if i > 0 {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(sequenceGap):
+				}
+			}
+			if started != nil {
+				started(i)
+			}
+			err := playWord(ctx, playCfg, path)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				playbackError(err)
+				return
+			}
+		}
+		if started != nil {
+			started(len(paths))
+		}
+	}()
+	return p
+}
+
+// stop interrupts playback and waits until it is finished
+func (p *playback) stop() {
+	p.cancel()
+	<-p.done
+}
+
+// playWord plays audio file cfg["REPEAT"] times until ctx is canceled
+func playWord(ctx context.Context, cfg Config, path string) error {
+	if path == "" {
+		return errors.New("no audio file to play")
+	}
+	repeat, _ := strconv.Atoi(cfg["REPEAT"])
+	gap, _ := strconv.Atoi(cfg["REPEAT_GAP"])
+	for i := 0; i < repeat || i == 0; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Duration(gap) * time.Millisecond):
+			}
+		}
+		if err := playOnce(ctx, cfg, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// playOnce plays audio file one time
+func playOnce(ctx context.Context, cfg Config, path string) error {
+	speed := playbackSpeed(cfg)
+	player := playerFor(cfg, path)
+	if player == "native" {
+		return playNative(ctx, path, speed)
+	}
+
+	args, err := playerArgs(player, path, speed)
+	if err != nil {
+		return err
+	}
+	if _, err = exec.LookPath(args[0]); err != nil {
+		return fmt.Errorf("player `%s` is not found in $PATH. "+
+			"Install it or change PLAYER in the config file", args[0])
+	}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	if err = cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("%s: %v", args[0], err)
+	}
+	return nil
+}
+
+// playbackSpeed returns playback speed from config
+func playbackSpeed(cfg Config) float64 {
+	speed, err := strconv.ParseFloat(cfg["SPEED"], 64)
+	if err != nil || speed < minSpeed || speed > maxSpeed {
+		return 1
+	}
+	return speed
+}
+
+// changeSpeed increases or decreases playback speed by one step
+func changeSpeed(cfg Config, faster bool) {
+	speed := playbackSpeed(cfg)
+	if faster {
+		speed += speedStep
+	} else {
+		speed -= speedStep
+	}
+	speed = math.Round(speed*10) / 10
+	speed = math.Max(minSpeed, math.Min(maxSpeed, speed))
+	cfg["SPEED"] = strconv.FormatFloat(speed, 'f', 1, 64)
+}
+
+// playerFor returns player for the audio file type: per-format setting if it
+// is set, otherwise the common one. If the player is auto or a preset which
+// can not play this format or change speed, the player is chosen by
+// autoPlayer. So is the built-in player for formats it can not decode.
+func playerFor(cfg Config, path string) string {
+	format := strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+	player := strings.TrimSpace(cfg["PLAYER_"+strings.ToUpper(format)])
+	if player == "" {
+		player = strings.TrimSpace(cfg["PLAYER"])
+	}
+	speed := playbackSpeed(cfg)
+	if player == "auto" || player == "native" && !decodable(format) {
+		return autoPlayer(format, speed)
+	}
+
+	preset, ok := playerPresets[player]
+	if !ok || preset.plays(format, speed) {
+		return player
+	}
+	return autoPlayer(format, speed)
+}
+
+// plays checks if a preset can play a format at the speed
+func (p playerPreset) plays(format string, speed float64) bool {
+	if speed != 1 && !p.speed {
+		return false
+	}
+	if p.formats == nil {
+		return true
+	}
+	for _, f := range p.formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// autoPlayers are presets tried in this order when the built-in player can
+// not be used
+var autoPlayers = []string{"mpv", "ffplay", "play", "mpg123"}
+
+// autoPlayer returns the built-in player if the sound server is available
+// and the player can decode the format, otherwise the first installed preset which can play the format at the
+// speed. Without any of them mpg123 is returned, so user is told to install
+// it.
+func autoPlayer(format string, speed float64) string {
+	if soundServer() && decodable(format) {
+		return "native"
+	}
+	for _, name := range autoPlayers {
+		preset := playerPresets[name]
+		if !preset.plays(format, speed) {
+			continue
+		}
+		if _, err := exec.LookPath(strings.Fields(preset.command)[0]); err == nil {
+			return name
+		}
+	}
+	return "mpg123"
+}
+
+// soundServer checks once if the built-in player can connect to PulseAudio.
+// It is used only on Linux.
+var soundServer = func() func() bool {
+	var once sync.Once
+	var available bool
+	return func() bool {
+		once.Do(func() {
+			if runtime.GOOS != "linux" {
+				return
+			}
+			client, err := pulse.NewClient(pulse.ClientApplicationName("tellme"))
+			if err == nil {
+				client.Close()
+				available = true
+			}
+		})
+		return available
+	}
+}()
+
+// playerArgs builds command line of an external player. Player is either
+// a preset name or a command template where {file} is replaced with path to
+// the audio file and {speed} with playback speed. If there is no {file} the
+// path is added at the end.
+func playerArgs(player, path string, speed float64) ([]string, error) {
+	if preset, ok := playerPresets[player]; ok {
+		player = preset.command
+	}
+
+	args, err := splitCommand(player)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, errors.New("player command is empty")
+	}
+	var hasFile bool
+	for i := range args {
+		args[i] = strings.ReplaceAll(args[i], "{speed}",
+			strconv.FormatFloat(speed, 'f', -1, 64))
+		if strings.Contains(args[i], "{file}") {
+			args[i] = strings.ReplaceAll(args[i], "{file}", path)
+			hasFile = true
+		}
+	}
+	if !hasFile {
+		args = append(args, path)
+	}
+	return args, nil
+}
+
+// playNative decodes audio file and plays it through PulseAudio (or PipeWire
+// with PulseAudio support)
+func playNative(ctx context.Context, path string, speed float64) error {
+	audio, err := decodeAudio(path)
+	if err != nil {
+		return err
+	}
+	audio = audio.stretch(speed)
+
+	client, err := pulse.NewClient(pulse.ClientApplicationName("tellme"))
+	if err != nil {
+		return fmt.Errorf("can not connect to sound server: %v", err)
+	}
+	defer client.Close()
+
+	pos := 0
+	reader := pulse.Float32Reader(func(buf []float32) (int, error) {
+		if ctx.Err() != nil {
+			return 0, pulse.EndOfData
+		}
+		n := copy(buf, audio.samples[pos:])
+		pos += n
+		if pos >= len(audio.samples) {
+			return n, pulse.EndOfData
+		}
+		return n, nil
+	})
+
+	channels := pulse.PlaybackStereo
+	if audio.channels == 1 {
+		channels = pulse.PlaybackMono
+	}
+	// small latency makes interruption of playback fast
+	stream, err := client.NewPlayback(reader, channels,
+		pulse.PlaybackSampleRate(audio.rate), pulse.PlaybackLatency(0.1))
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	stream.Start()
+	stream.Drain()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return stream.Error()
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type playlistEntry struct {
+	word, author, file string
+	seconds            int
+}
+
+// playlistFlags adds options of `playlist` command
+func playlistFlags(fs *flag.FlagSet) {
+	config["PLAYLIST_GAP"] = "1000"
+	fs.Func("gap", "pause between words of a single track in `milliseconds`. Default 1000",
+		func(s string) error {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				return errors.New("have to be a non-negative integer")
+			}
+			config["PLAYLIST_GAP"] = s
+			return nil
+		})
+}
+
+// playlist saves pronunciations of words and writes M3U or PLS playlist of
+// them, or joins them into a single audio track. The kind of result is taken
+// from the output file extension.
+func playlist(cfg Config, args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "output file name is missing")
+		os.Exit(1)
+	}
+	output := args[0]
+	words := readWords(cfg, args[1:])
+	if len(words) == 0 {
+		fmt.Fprintln(os.Stderr, "no words for playlist")
+		os.Exit(1)
+	}
+
+	var err error
+	switch ext := strings.TrimPrefix(filepath.Ext(output), "."); ext {
+	case "m3u", "pls":
+		entries := savePlaylistFiles(cfg, words, filepath.Dir(output))
+		if len(entries) == 0 {
+			fmt.Fprintln(os.Stderr, "no pronunciations for playlist")
+			os.Exit(1)
+		}
+		if ext == "m3u" {
+			err = writeM3U(output, entries)
+		} else {
+			err = writePLS(output, entries)
+		}
+		if err == nil {
+			fmt.Printf("Saved playlist of %d words to %s\n", len(entries), output)
+		}
+	default:
+		if _, ok := ffmpegCodecs[ext]; !ok {
+			fmt.Fprintln(os.Stderr, "output file has to be .m3u, .pls or audio file "+
+				"(.wav, .mp3, .ogg, .flac, .m4a, .opus)")
+			os.Exit(1)
+		}
+		err = writeTrack(cfg, output, words)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// savePlaylistFiles saves the first pronunciation of every word in dir and
+// returns playlist entries of saved files
+func savePlaylistFiles(cfg Config, words []string, dir string) []playlistEntry {
+	cfg["DOWNLOAD"] = "yes"
+
+	var entries []playlistEntry
+	for _, word := range words {
+		list := getPronList(cfg, word)
+		if len(list) == 0 {
+			continue
+		}
+		item := list[0]
+		name := item.aFile
+		item.aFile = filepath.Join(dir, name)
+		if path, err := saveWord(cfg, item); err != nil || path != item.aFile {
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			fmt.Fprintf(os.Stderr, "can not save audio for '%s'\n", word)
+			continue
+		}
+
+		entry := playlistEntry{word: word, author: item.author, file: name,
+			seconds: -1}
+		if audio, err := decodeAudio(item.aFile); err == nil {
+			entry.seconds = int(audio.duration().Round(time.Second).Seconds())
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// writeM3U writes extended M3U playlist
+func writeM3U(path string, entries []playlistEntry) error {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	for _, e := range entries {
+		fmt.Fprintf(&b, "#EXTINF:%d,%s - %s\n%s\n", e.seconds, e.word, e.author,
+			e.file)
+	}
+	return os.WriteFile(path, []byte(b.String()), 0640)
+}
+
+// writePLS writes PLS playlist
+func writePLS(path string, entries []playlistEntry) error {
+	var b strings.Builder
+	b.WriteString("[playlist]\n")
+	for i, e := range entries {
+		fmt.Fprintf(&b, "File%d=%s\nTitle%d=%s - %s\nLength%d=%d\n",
+			i+1, e.file, i+1, e.word, e.author, i+1, e.seconds)
+	}
+	fmt.Fprintf(&b, "NumberOfEntries=%d\nVersion=2\n", len(entries))
+	return os.WriteFile(path, []byte(b.String()), 0640)
+}
+
+// writeTrack joins the first pronunciations of words into a single audio
+// file with pauses between them. Every word is announced by TTS command if
+// it is set.
+func writeTrack(cfg Config, output string, words []string) error {
+	tmp, err := os.MkdirTemp("", "tellme")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	gap, _ := strconv.Atoi(cfg["PLAYLIST_GAP"])
+	track := &pcm{}
+	var count int
+	for _, word := range words {
+		list := getPronList(cfg, word)
+		if len(list) == 0 {
+			continue
+		}
+		audio, err := trackClip(cfg, list[0], tmp)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "can not get audio for '%s': %v\n", word, err)
+			continue
+		}
+		if track.rate == 0 {
+			track.rate, track.channels = audio.rate, audio.channels
+		}
+
+		if count > 0 {
+			track.appendSilence(gap)
+		}
+		if cfg["TTS"] != "" {
+			speech, err := ttsClip(cfg, word, tmp)
+			if err != nil {
+				return err
+			}
+			track.append(speech)
+			track.appendSilence(gap / 2)
+		}
+		track.append(audio)
+		count++
+		if cfg["VERBOSE"] == "yes" {
+			fmt.Printf("Add to track: `%s`\n", word)
+		}
+	}
+	if count == 0 {
+		return errors.New("no pronunciations for track")
+	}
+
+	wav := output
+	if filepath.Ext(output) != ".wav" {
+		wav = filepath.Join(tmp, "track.wav")
+	}
+	if err = writeWav(wav, track); err != nil {
+		return err
+	}
+	if wav != output {
+		if err = convertAudio(cfg, wav, output); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Saved %d words (%s) to %s\n", count,
+		track.duration().Round(time.Second), output)
+	return nil
+}
+
+// trackClip returns decoded audio of a pronunciation. The file is taken from
+// cache or downloaded into tmp directory and processed if it is enabled.
+func trackClip(cfg Config, item Pron, tmp string) (*pcm, error) {
+	var src string
+	var err error
+	if cfg["CACHE"] == "yes" {
+		if src, err = cacheAudio(cfg, item); err != nil {
+			return nil, err
+		}
+	} else {
+		src = filepath.Join(tmp, filepath.Base(item.cacheFile))
+		if err = getAudio(cfg, item.aURL, src); err != nil {
+			return nil, err
+		}
+	}
+	if processingEnabled(cfg) {
+		if src, err = processAudio(cfg, src); err != nil {
+			return nil, err
+		}
+	}
+	return decodeAudio(src)
+}
+
+// ttsClip runs TTS command to get spoken text as wav file in tmp directory
+// and decodes it
+func ttsClip(cfg Config, text, tmp string) (*pcm, error) {
+	args, err := splitCommand(cfg["TTS"])
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, errors.New("TTS command is empty")
+	}
+	file := filepath.Join(tmp, "tts.wav")
+	os.Remove(file)
+	for i := range args {
+		args[i] = strings.ReplaceAll(args[i], "{text}", text)
+		args[i] = strings.ReplaceAll(args[i], "{file}", file)
+	}
+
+	if _, err = exec.LookPath(args[0]); err != nil {
+		return nil, fmt.Errorf("TTS command `%s` is not found in $PATH. "+
+			"Install it or change TTS in the config file", args[0])
+	}
+	out, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("TTS command failed: %v: %s", err,
+			strings.TrimSpace(string(out)))
+	}
+	return decodeAudio(file)
+}
+
+// append adds audio to the end converting its rate and channels
+func (p *pcm) append(audio *pcm) {
+	audio = audio.resample(p.rate).remix(p.channels)
+	p.samples = append(p.samples, audio.samples...)
+}
+
+// appendSilence adds ms milliseconds of silence to the end
+func (p *pcm) appendSilence(ms int) {
+	frames := p.rate * ms / 1000
+	p.samples = append(p.samples, make([]float32, frames*p.channels)...)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// prefetchFlags adds options of `prefetch` command
+func prefetchFlags(fs *flag.FlagSet) {
+	config["PREFETCH_TOP"] = "0"
+	fs.Func("n", "download only `N` first pronunciations of every word. Default all",
+		func(s string) error {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				return errors.New("have to be a non-negative integer")
+			}
+			config["PREFETCH_TOP"] = s
+			return nil
+		})
+}
+
+// prefetch fills the cache with pronunciation lists and audio files of words
+// without saving anything in the current directory
+func prefetch(cfg Config, args []string) {
+	cfg["CACHE"] = "yes"
+	cfg["DOWNLOAD"] = "no"
+
+	words := readWords(cfg, args)
+	if len(words) == 0 {
+		fmt.Fprintln(os.Stderr, "no words to prefetch")
+		os.Exit(1)
+	}
+	top, _ := strconv.Atoi(cfg["PREFETCH_TOP"])
+
+	var failed int
+	for i, word := range words {
+		list := getPronList(cfg, word)
+		if len(list) == 0 {
+			failed++
+			continue
+		}
+		if top > 0 && top < len(list) {
+			list = list[:top]
+		}
+
+		var cached int
+		for _, item := range list {
+			if _, err := cacheAudio(cfg, item); err != nil {
+				fmt.Fprintf(os.Stderr, "can not download audio for '%s': %v\n",
+					word, err)
+				continue
+			}
+			cached++
+		}
+		fmt.Printf("[%d/%d] %s: %d of %d audio files cached\n",
+			i+1, len(words), word, cached, len(list))
+	}
+
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, "no pronunciations for %d of %d words\n",
+			failed, len(words))
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const cacheProcessedDir = "processed"
+const silenceThreshold = -45.0 // dBFS
+const silencePad = 0.05        // seconds kept around trimmed sound
+const peakLimit = 0.98         // maximal sample value after normalization
+
+// processingEnabled returns true if saved files have to be processed
+func processingEnabled(cfg Config) bool {
+	return cfg["TRIM_SILENCE"] == "yes" || cfg["NORMALIZE"] == "yes"
+}
+
+// processedPath returns path of processed version of an audio file. Name
+// depends on processing options, so changing them does not reuse old files.
+// Processed files of the cached audio are kept in the cache too. Without
+// cache the source is a temporary file and the processed one is put next to
+// it, so both are removed together.
+func processedPath(cfg Config, src string) string {
+	name := strings.TrimSuffix(filepath.Base(src), filepath.Ext(src))
+	name += "_" + filepath.Ext(src)[1:]
+	if cfg["TRIM_SILENCE"] == "yes" {
+		name += "_trim"
+	}
+	if cfg["NORMALIZE"] == "yes" {
+		name += "_lufs" + cfg["TARGET_LUFS"]
+	}
+	name += ".wav"
+
+	if cfg["CACHE"] != "yes" {
+		return filepath.Join(filepath.Dir(src), name)
+	}
+	return filepath.Join(cfg["CACHE_DIR"], cacheProcessedDir, hashBucket(name), name)
+}
+
+// processAudio makes processed version of an audio file: trims silence and
+// normalizes loudness according to the config. Returns path to wav file
+// with the result. Original file stays intact.
+func processAudio(cfg Config, src string) (string, error) {
+	dst := processedPath(cfg, src)
+	if _, err := os.Stat(dst); err == nil {
+		return dst, nil
+	}
+	if cfg["VERBOSE"] == "yes" {
+		fmt.Printf("Process file: `%s`\n", src)
+	}
+
+	audio, err := decodeAudio(src)
+	if err != nil {
+		return "", err
+	}
+	if cfg["TRIM_SILENCE"] == "yes" {
+		audio = audio.trimSilence(silenceThreshold)
+	}
+	if cfg["NORMALIZE"] == "yes" {
+		target, err := strconv.ParseFloat(cfg["TARGET_LUFS"], 64)
+		if err != nil {
+			return "", fmt.Errorf("wrong target loudness: %s", cfg["TARGET_LUFS"])
+		}
+		audio = audio.normalize(target)
+	}
+
+	if err = os.MkdirAll(filepath.Dir(dst), 0750); err != nil {
+		return "", err
+	}
+	if err = writeWav(dst, audio); err != nil {
+		os.Remove(dst)
+		return "", err
+	}
+	return dst, nil
+}
+
+// trimSilence removes leading and trailing parts of audio which are quieter
+// than threshold in dBFS, keeping a short pause around the sound
+func (p *pcm) trimSilence(threshold float64) *pcm {
+	win := p.rate / 100 // 10ms
+	if win == 0 || p.frames() < win {
+		return p
+	}
+	level := math.Pow(10, threshold/20)
+
+	loud := func(frame int) bool {
+		var sum float64
+		for i := frame * p.channels; i < (frame+win)*p.channels; i++ {
+			sum += float64(p.samples[i] * p.samples[i])
+		}
+		return math.Sqrt(sum/float64(win*p.channels)) > level
+	}
+
+	start, end := -1, -1
+	for f := 0; f+win <= p.frames(); f += win {
+		if loud(f) {
+			if start < 0 {
+				start = f
+			}
+			end = f + win
+		}
+	}
+	if start < 0 {
+		return p
+	}
+
+	pad := int(silencePad * float64(p.rate))
+	start -= pad
+	if start < 0 {
+		start = 0
+	}
+	end += pad
+	if end > p.frames() {
+		end = p.frames()
+	}
+	return &pcm{
+		rate:     p.rate,
+		channels: p.channels,
+		samples:  p.samples[start*p.channels : end*p.channels],
+	}
+}
+
+// loudness measures integrated loudness of audio in LUFS according to
+// ITU-R BS.1770: K-weighting, 400ms blocks and absolute and relative gating
+func (p *pcm) loudness() float64 {
+	frames := p.frames()
+	if frames == 0 {
+		return math.Inf(-1)
+	}
+
+	// K-weighting filter is a high shelf followed by a high pass
+	weighted := make([][]float64, p.channels)
+	shelf, highPass := kWeightingFilters(float64(p.rate))
+	for c := range weighted {
+		weighted[c] = make([]float64, frames)
+		for i := 0; i < frames; i++ {
+			weighted[c][i] = float64(p.samples[i*p.channels+c])
+		}
+		shelf.apply(weighted[c])
+		highPass.apply(weighted[c])
+	}
+
+	block := int(0.4 * float64(p.rate))
+	step := block / 4
+	if block > frames {
+		// clips shorter than one block are measured as a whole
+		block, step = frames, frames
+	}
+	var powers []float64
+	for start := 0; start+block <= frames; start += step {
+		var power float64
+		for c := range weighted {
+			var sum float64
+			for _, v := range weighted[c][start : start+block] {
+				sum += v * v
+			}
+			power += sum / float64(block)
+		}
+		powers = append(powers, power)
+	}
+
+	gated := func(threshold float64) (float64, int) {
+		var sum float64
+		var n int
+		for _, power := range powers {
+			if blockLoudness(power) > threshold {
+				sum += power
+				n++
+			}
+		}
+		return sum, n
+	}
+	sum, n := gated(-70)
+	if n == 0 {
+		return math.Inf(-1)
+	}
+	relative := blockLoudness(sum/float64(n)) - 10
+	sum, n = gated(relative)
+	if n == 0 {
+		return math.Inf(-1)
+	}
+	return blockLoudness(sum / float64(n))
+}
+
+// blockLoudness converts mean square power to LUFS
+func blockLoudness(power float64) float64 {
+	return -0.691 + 10*math.Log10(power)
+}
+
+// normalize changes gain of audio to reach target loudness in LUFS. Gain is
+// reduced if the peaks would be clipped.
+func (p *pcm) normalize(target float64) *pcm {
+	current := p.loudness()
+	if math.IsInf(current, -1) {
+		return p
+	}
+	gain := math.Pow(10, (target-current)/20)
+
+	var peak float64
+	for _, v := range p.samples {
+		peak = math.Max(peak, math.Abs(float64(v)))
+	}
+	if peak*gain > peakLimit {
+		gain = peakLimit / peak
+	}
+
+	out := &pcm{
+		rate:     p.rate,
+		channels: p.channels,
+		samples:  make([]float32, len(p.samples)),
+	}
+	for i, v := range p.samples {
+		out.samples[i] = float32(float64(v) * gain)
+	}
+	return out
+}
+
+type biquad struct {
+	b0, b1, b2, a1, a2 float64
+}
+
+// apply filters samples in place
+func (f biquad) apply(x []float64) {
+	var x1, x2, y1, y2 float64
+	for i, v := range x {
+		y := f.b0*v + f.b1*x1 + f.b2*x2 - f.a1*y1 - f.a2*y2
+		x2, x1 = x1, v
+		y2, y1 = y1, y
+		x[i] = y
+	}
+}
+
+// kWeightingFilters returns BS.1770 K-weighting filters for a sample rate
+func kWeightingFilters(rate float64) (biquad, biquad) {
+	// high shelf modelling the acoustic effect of the head
+	f0, gain, q := 1681.974450955533, 3.999843853973347, 0.7071752369554196
+	k := math.Tan(math.Pi * f0 / rate)
+	vh := math.Pow(10, gain/20)
+	vb := math.Pow(vh, 0.4996667741545416)
+	a0 := 1 + k/q + k*k
+	shelf := biquad{
+		b0: (vh + vb*k/q + k*k) / a0,
+		b1: 2 * (k*k - vh) / a0,
+		b2: (vh - vb*k/q + k*k) / a0,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/q + k*k) / a0,
+	}
+
+	// high pass filter
+	f0, q = 38.13547087602444, 0.5003270373238773
+	k = math.Tan(math.Pi * f0 / rate)
+	a0 = 1 + k/q + k*k
+	highPass := biquad{
+		b0: 1,
+		b1: -2,
+		b2: 1,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/q + k*k) / a0,
+	}
+	return shelf, highPass
+}
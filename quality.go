@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/cmplx"
+	"time"
+)
+
+const minClipLevel = -50.0 // dBFS, RMS of quieter recordings is silence
+const clipLevel = 0.99     // samples above are clipped
+const maxClipRatio = 0.01  // part of clipped samples allowed
+const minClipLength = 250 * time.Millisecond
+const maxClipLength = 8 * time.Second
+const noiseFrame = 512    // samples in a frame of spectral analysis
+const noiseFlatness = 0.4 // spectral flatness of hiss is about 0.56
+const maxNoiseRatio = 0.5 // part of noise-like frames allowed
+
+// problem returns what is wrong with a recording: "too short", "silent",
+// "clipped", "noisy" or "too long". Returns empty string for good
+// recordings.
+func (p *pcm) problem() string {
+	var power float64
+	var clipped int
+	for _, v := range p.samples {
+		power += float64(v) * float64(v)
+		if math.Abs(float64(v)) >= clipLevel {
+			clipped++
+		}
+	}
+	switch {
+	case p.duration() < minClipLength:
+		return "too short"
+	case power == 0 || 10*math.Log10(power/float64(len(p.samples))) < minClipLevel:
+		return "silent"
+	case float64(clipped) > maxClipRatio*float64(len(p.samples)):
+		return "clipped"
+	case p.noisy():
+		return "noisy"
+	case p.duration() > maxClipLength:
+		return "too long"
+	}
+	return ""
+}
+
+// noisy checks if a recording is mostly noise. Spectrum of voice has peaks of
+// harmonics, while spectrum of hiss is flat, so the recording is noisy if
+// most frames louder than silence have flat spectra.
+func (p *pcm) noisy() bool {
+	mono := p.remix(1)
+	spectrum := make([]complex128, noiseFrame)
+	var frames, flat int
+	for start := 0; start+noiseFrame <= len(mono.samples); start += noiseFrame {
+		var power float64
+		for i, v := range mono.samples[start : start+noiseFrame] {
+			power += float64(v) * float64(v)
+			// Hann window keeps tones from leaking into other bins
+			hann := 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/noiseFrame)
+			spectrum[i] = complex(float64(v)*hann, 0)
+		}
+		if power == 0 || 10*math.Log10(power/noiseFrame) < minClipLevel {
+			continue
+		}
+		frames++
+		fft(spectrum)
+		if spectralFlatness(spectrum[1:noiseFrame/2]) > noiseFlatness {
+			flat++
+		}
+	}
+	return frames > 0 && float64(flat) > maxNoiseRatio*float64(frames)
+}
+
+// spectralFlatness returns geometric mean of power spectrum divided by its
+// arithmetic mean: near 0 for tones and near 0.56 for white noise
+func spectralFlatness(spectrum []complex128) float64 {
+	var logSum, sum float64
+	for _, x := range spectrum {
+		power := real(x)*real(x) + imag(x)*imag(x) + 1e-20
+		logSum += math.Log(power)
+		sum += power
+	}
+	n := float64(len(spectrum))
+	return math.Exp(logSum/n) / (sum / n)
+}
+
+// fft replaces samples with their discrete Fourier transform in place.
+// Number of samples has to be a power of two.
+func fft(x []complex128) {
+	n := len(x)
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+	for size := 2; size <= n; size <<= 1 {
+		step := cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			w := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				a, b := x[start+k], w*x[start+k+size/2]
+				x[start+k], x[start+k+size/2] = a+b, a-b
+				w *= step
+			}
+		}
+	}
+}
+
+// demoteBroken moves pronunciations with silent, clipped, noisy, too short or
+// too long audio to the end of the list. Only audio already downloaded to
+// the cache or the temporary directory is checked, audio which is not
+// downloaded yet is never demoted.
+func demoteBroken(cfg Config, list []Pron) []Pron {
+	if cfg["QUALITY_CHECK"] != "yes" {
+		return list
+	}
+	var good, broken []Pron
+	for _, item := range list {
+		path := downloadedAudio(item)
+		if path == "" {
+			good = append(good, item)
+			continue
+		}
+		info, err := loadClipInfo(path)
+		if err != nil || info.problem == "" {
+			good = append(good, item)
+			continue
+		}
+		if cfg["VERBOSE"] == "yes" {
+			fmt.Printf("Recording of %s is %s\n", item.fullAuthor, info.problem)
+		}
+		broken = append(broken, item)
+	}
+	return append(good, broken...)
+}
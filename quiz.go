@@ -0,0 +1,305 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"golang.org/x/term"
+	"golang.org/x/text/unicode/norm"
+)
+
+// results of checking an answer in quiz mode
+const (
+	answerCorrect = iota
+	answerAccents
+	answerTypo
+	answerWrong
+)
+
+// quiz is a listening quiz: a random pronunciation of a word is played and
+// user types the word
+type quiz struct {
+	*session
+	order  []string
+	rounds int
+	round  int
+	item   *Pron
+	// pick chooses one of pronunciations of a word
+	pick     func(list []Pron) Pron
+	answer   string
+	result   int
+	answered bool
+	correct  int
+	mistakes []string
+}
+
+// quizFlags adds options of `quiz` command
+func quizFlags(fs *flag.FlagSet) {
+	config["QUIZ_ROUNDS"] = "10"
+	fs.Func("n", "ask `N` words, 0 for all words. Default 10",
+		func(s string) error {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				return errors.New("have to be a non-negative integer")
+			}
+			config["QUIZ_ROUNDS"] = s
+			return nil
+		})
+}
+
+// runQuiz plays pronunciations of random words and asks user to type them.
+// Words come from arguments, -f file or the cache.
+func runQuiz(cfg Config, args []string) {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		fmt.Fprintln(os.Stderr, "quiz needs a terminal")
+		os.Exit(1)
+	}
+	words := readWords(cfg, args)
+	if len(words) == 0 {
+		words = cachedWords(cfg)
+	}
+	if len(words) == 0 {
+		fmt.Fprintln(os.Stderr, "no words for quiz: give words or fill the cache with prefetch")
+		os.Exit(1)
+	}
+	// audio is played from the cache or temporary files only
+	cfg["DOWNLOAD"] = "no"
+	cfg["INTERACTIVE"] = "yes"
+	q, err := newQuiz(cfg, words, rand.New(rand.NewSource(time.Now().UnixNano())))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	tmpDir, err = os.MkdirTemp("", "tellme")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer os.RemoveAll(tmpDir)
+	if err = q.fullScreen(q.run); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Print(q.summary())
+}
+
+// newQuiz prepares a quiz of words in random order
+func newQuiz(cfg Config, words []string, rnd *rand.Rand) (*quiz, error) {
+	s, err := newSession(cfg)
+	if err != nil {
+		return nil, err
+	}
+	order := append([]string{}, words...)
+	rnd.Shuffle(len(order), func(i, j int) { order[i], order[j] = order[j], order[i] })
+
+	rounds, _ := strconv.Atoi(cfg["QUIZ_ROUNDS"])
+	if rounds == 0 || rounds > len(order) {
+		rounds = len(order)
+	}
+	q := &quiz{session: s, order: order, rounds: rounds}
+	s.screen = q.render
+	q.pick = func(list []Pron) Pron {
+		return list[rnd.Intn(len(list))]
+	}
+	return q, nil
+}
+
+// run asks words until all rounds are played or user quits
+func (q *quiz) run() {
+	defer q.stop()
+	for len(q.order) > 0 && q.round < q.rounds {
+		word := q.order[0]
+		q.order = q.order[1:]
+		q.setStatus(fmt.Sprintf("Loading pronunciation %d...", q.round+1))
+		q.draw()
+		list := getPronList(q.cfg, word)
+		q.setStatus("")
+		if len(list) == 0 {
+			continue
+		}
+		item := q.pick(list)
+		q.item, q.answered = &item, false
+		q.round++
+
+		q.play(item)
+		answer, quit := q.ask()
+		if quit {
+			return
+		}
+		q.check(answer)
+		q.draw()
+		key, ok := q.nextKey()
+		if key = keyName(key); !ok || key == "ctrl-c" || q.keymap.action(key) == "quit" {
+			return
+		}
+	}
+}
+
+// ask reads the answer. Tab and Ctrl-R replay the pronunciation, Esc gives
+// up. Returns true if user wants to quit.
+func (q *quiz) ask() (answer string, quit bool) {
+	ed := newLineEditor(nil, nil)
+	q.mu.Lock()
+	q.editor = ed
+	q.mu.Unlock()
+	defer func() {
+		q.mu.Lock()
+		q.editor = nil
+		q.mu.Unlock()
+	}()
+
+	for {
+		q.draw()
+		key, ok := q.nextKey()
+		if !ok {
+			return "", true
+		}
+		switch keyName(key) {
+		case "tab", "ctrl-r":
+			q.play(*q.item)
+			continue
+		case "ctrl-c":
+			return "", true
+		}
+		q.mu.Lock()
+		done, cancel := ed.handle(key)
+		q.mu.Unlock()
+		if done || cancel {
+			return ed.String(), false
+		}
+	}
+}
+
+// check compares the answer with the word and updates statistics
+func (q *quiz) check(answer string) {
+	q.answer = answer
+	q.answered = true
+	q.result = checkAnswer(answer, q.item.word)
+	if q.result == answerCorrect {
+		q.correct++
+		return
+	}
+	typed := answer
+	if typed == "" {
+		typed = "-"
+	}
+	q.mistakes = append(q.mistakes, typed+" → "+q.item.word)
+}
+
+// checkAnswer compares typed text with a word. Both are normalized to NFC,
+// so precomposed and combining accents are equal, and case and extra spaces
+// are ignored. Wrong answers which differ only by accents or by a typo are
+// told apart.
+func checkAnswer(answer, word string) int {
+	a, w := normalizeAnswer(answer), normalizeAnswer(word)
+	switch {
+	case a == w:
+		return answerCorrect
+	case stripMarks(a) == stripMarks(w):
+		return answerAccents
+	case a != "" && editDistance(a, w) == 1:
+		return answerTypo
+	}
+	return answerWrong
+}
+
+// normalizeAnswer returns text in NFC form in lower case with single spaces
+func normalizeAnswer(s string) string {
+	s = norm.NFC.String(strings.ToLower(norm.NFC.String(s)))
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// stripMarks removes accents and other combining marks from text
+func stripMarks(s string) string {
+	var b strings.Builder
+	for _, r := range norm.NFD.String(s) {
+		if !unicode.Is(unicode.Mn, r) {
+			b.WriteRune(r)
+		}
+	}
+	return norm.NFC.String(b.String())
+}
+
+// render returns screen lines of quiz mode
+func (q *quiz) render(width, height int) []string {
+	if width < tuiMinWidth {
+		width = tuiMinWidth
+	}
+	if height < tuiMinHeight {
+		height = tuiMinHeight
+	}
+	blank := strings.Repeat(" ", width)
+	lines := []string{ansiReverse + fit(fmt.Sprintf(" tellme-go quiz  [%s]",
+		q.cfg["LANG"]), width) + ansiReset, blank}
+
+	if q.item != nil {
+		lines = append(lines, fit(fmt.Sprintf("   Word %d of %d", q.round, q.rounds), width),
+			blank)
+		if q.answered {
+			var verdict string
+			switch q.result {
+			case answerCorrect:
+				verdict = "✓ Correct: "
+			case answerAccents:
+				verdict = "✗ Check the accents: "
+			case answerTypo:
+				verdict = "✗ Almost: "
+			default:
+				verdict = "✗ The word is: "
+			}
+			lines = append(lines, "   "+ansiBold+fit(verdict+q.item.word, width-3)+ansiReset)
+			if q.result != answerCorrect {
+				lines = append(lines, fit("   You typed: "+q.answer, width))
+			}
+			lines = append(lines, fit(fmt.Sprintf("   %s (%s from %s)", q.item.author,
+				q.item.sex, q.item.country), width), blank,
+				fit("   Press any key to continue", width))
+		} else {
+			lines = append(lines, fit("   Type the word you hear", width))
+		}
+	}
+	for len(lines) < height-2 {
+		lines = append(lines, blank)
+	}
+	lines = lines[:height-2]
+
+	status := fmt.Sprintf(" correct %d of %d", q.correct, q.done())
+	if q.status != "" {
+		status += "  │ " + q.status
+	}
+	if q.editor != nil {
+		lines = append(lines, editorBar(status+"  │ Answer: ", q.editor, width))
+	} else {
+		lines = append(lines, ansiReverse+fit(status, width)+ansiReset)
+	}
+	return append(lines, fit("Tab:replay  Esc:give up  Ctrl-C:quit", width))
+}
+
+// done returns number of answered words
+func (q *quiz) done() int {
+	if q.item != nil && !q.answered {
+		return q.round - 1
+	}
+	return q.round
+}
+
+// summary returns accuracy and mistakes of the quiz
+func (q *quiz) summary() string {
+	if q.done() == 0 {
+		return "No words answered.\n"
+	}
+	text := fmt.Sprintf("Correct %d of %d (%d%%).\n", q.correct, q.done(),
+		q.correct*100/q.done())
+	if len(q.mistakes) > 0 {
+		text += "Mistakes:\n  " + strings.Join(q.mistakes, "\n  ") + "\n"
+	}
+	return text
+}
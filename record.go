@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// defaultRecordTime is recording time in seconds if length of the native
+// pronunciation is unknown
+const defaultRecordTime = 3
+
+// recordingPath returns path of user's recording of a pronunciation. It is
+// kept next to the cached audio of the pronunciation.
+func recordingPath(item Pron) string {
+	return strings.TrimSuffix(item.cacheFile, filepath.Ext(item.cacheFile)) + ".mine.wav"
+}
+
+// recordTime returns recording time in seconds: length of the native
+// pronunciation and a second to start speaking
+func recordTime(native string) int {
+	audio, err := decodeAudio(native)
+	if err != nil || audio.rate == 0 || audio.channels == 0 {
+		return defaultRecordTime
+	}
+	frames := len(audio.samples) / audio.channels
+	return (frames+audio.rate-1)/audio.rate + 1
+}
+
+// recordVoice runs RECORDER command to record user's voice to a wav file.
+// Placeholders {file} and {seconds} are replaced with the file and
+// recording time.
+func recordVoice(cfg Config, file string, seconds int) error {
+	args, err := splitCommand(cfg["RECORDER"])
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return errors.New("recorder command is empty. Set RECORDER in the config file")
+	}
+	if err = os.MkdirAll(filepath.Dir(file), 0750); err != nil {
+		return err
+	}
+	os.Remove(file)
+	for i := range args {
+		args[i] = strings.ReplaceAll(args[i], "{seconds}", strconv.Itoa(seconds))
+		args[i] = strings.ReplaceAll(args[i], "{file}", file)
+	}
+
+	if _, err = exec.LookPath(args[0]); err != nil {
+		return fmt.Errorf("recorder `%s` is not found in $PATH. "+
+			"Install it or change RECORDER in the config file", args[0])
+	}
+	out, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("recorder failed: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	if _, err = os.Stat(file); err != nil {
+		return fmt.Errorf("recorder has not written %s", file)
+	}
+	return nil
+}
+
+// record records user saying a word and plays the native pronunciation and
+// the recording one after another
+func (s *session) record(item Pron) {
+	s.stop()
+	native, err := playableFile(s.cfg, item)
+	if err != nil && native == "" {
+		s.setStatus(err.Error())
+		return
+	}
+	if native == "" {
+		s.setStatus(fmt.Sprintf("Can not get pronunciation of `%s`", item.word))
+		return
+	}
+	seconds := recordTime(native)
+	s.setStatus(fmt.Sprintf("Recording %d s... Say `%s`", seconds, item.word))
+	s.draw()
+
+	file := recordingPath(item)
+	if err := recordVoice(s.cfg, file, seconds); err != nil {
+		s.setStatus(err.Error())
+		return
+	}
+	labels := []string{"Playing: " + item.author, "Playing: you", ""}
+	s.player = startSequence(s.cfg, []string{native, file}, func(i int) {
+		s.setStatus(labels[i])
+		s.requestRedraw()
+	})
+}
@@ -0,0 +1,623 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// WordSource gives words to an interactive session one by one
+type WordSource interface {
+	// Next returns the next word or false if there are no more words
+	Next() (string, bool)
+	// Close releases the source and returns an error if reading failed
+	Close() error
+}
+
+// argsSource gives words from command line arguments or history
+type argsSource struct {
+	words []string
+}
+
+// fileSource reads words from a file line by line when they are needed
+type fileSource struct {
+	file    *os.File
+	scanner *bufio.Scanner
+}
+
+// keyPress is a key read in background or error of reading it
+type keyPress struct {
+	key string
+	err error
+}
+
+// promptSource asks user for every next word
+type promptSource struct {
+	prompt func(text string) string
+}
+
+// session is an interactive session: words from a source, pronunciations of
+// the current word and handling of keys. Keys come from readKey and the
+// screen is written to out, so sessions can be scripted in tests. Only the
+// main loop reads and changes the session; background playback asks it to
+// redraw the screen through redraw channel.
+type session struct {
+	cfg     Config
+	keymap  *keymap
+	library *library
+	source  WordSource
+	eof     bool
+	words   []string
+	wordIdx int
+	pronIdx int
+	lists   map[string][]Pron
+	// suggestions are similar words for words without pronunciations
+	suggestions map[string][]string
+	// played are the last played pronunciations of words, history keeps
+	// recent words for the prompt
+	played  map[string]Pron
+	history []string
+	// comparing are pronunciations played to compare accents, compareIdx is
+	// the one playing now
+	comparing  []Pron
+	compareIdx int
+	// clips are durations and waveforms of downloaded audio files, nil if
+	// a file can not be decoded
+	clips  map[string]*clipInfo
+	number string
+	status string
+	// editor is the line editor of the prompt shown after status
+	editor  *lineEditor
+	player  *playback
+	readKey func() (string, error)
+	keys    chan keyPress
+	redraw  chan struct{}
+	// err is the error which ended the session
+	err     error
+	play    func(item Pron)
+	playAll func(items []Pron)
+	out     io.Writer
+	// screen returns lines of the screen, render by default
+	screen func(width, height int) []string
+	width  int
+	height int
+	mu     sync.Mutex
+}
+
+// newWordSource returns source of words for interactive mode: command line
+// arguments, words from history with -recent option, file set by -f option
+// or words entered by user
+func newWordSource(cfg Config, args []string, prompt func(text string) string) (WordSource, error) {
+	var words []string
+	for _, word := range args {
+		if word != "" {
+			words = append(words, word)
+		}
+	}
+	if len(words) > 0 {
+		return &argsSource{words: words}, nil
+	}
+	if cfg["RECENT"] == "yes" {
+		words, err := historyWords(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return &argsSource{words: words}, nil
+	}
+	if cfg["FILE"] != "" {
+		return newFileSource(cfg["FILE"])
+	}
+	return &promptSource{prompt: prompt}, nil
+}
+
+func (s *argsSource) Next() (string, bool) {
+	if len(s.words) == 0 {
+		return "", false
+	}
+	word := s.words[0]
+	s.words = s.words[1:]
+	return word, true
+}
+
+func (s *argsSource) Close() error {
+	return nil
+}
+
+// newFileSource opens file with words
+func newFileSource(path string) (*fileSource, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &fileSource{file: file, scanner: bufio.NewScanner(file)}, nil
+}
+
+func (s *fileSource) Next() (string, bool) {
+	for s.scanner.Scan() {
+		if word := s.scanner.Text(); word != "" {
+			return word, true
+		}
+	}
+	return "", false
+}
+
+func (s *fileSource) Close() error {
+	s.file.Close()
+	return s.scanner.Err()
+}
+
+func (s *promptSource) Next() (string, bool) {
+	word := s.prompt("Enter a new word: ")
+	return word, word != ""
+}
+
+func (s *promptSource) Close() error {
+	return nil
+}
+
+// newSession creates a session reading keys from keyboard and drawing to
+// standard output. Returns error if key bindings in cfg are wrong.
+func newSession(cfg Config) (*session, error) {
+	km, err := newKeymap(cfg)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := readHistory(cfg["HISTORY"])
+	if err != nil {
+		return nil, err
+	}
+	lib, err := openLibrary(cfg)
+	if err != nil {
+		return nil, err
+	}
+	s := &session{
+		cfg:         cfg,
+		keymap:      km,
+		library:     lib,
+		lists:       make(map[string][]Pron),
+		suggestions: make(map[string][]string),
+		played:      make(map[string]Pron),
+		clips:       make(map[string]*clipInfo),
+		history:     recentWords(entries, cfg["LANG"]),
+		readKey:     getChar,
+		redraw:      make(chan struct{}, 1),
+		out:         os.Stdout,
+	}
+	s.play = s.playInBackground
+	s.playAll = s.playSequence
+	s.screen = s.render
+	return s, nil
+}
+
+// run handles keys until user quits or the source has no words at all.
+// Words are taken from the source one by one when user goes past the last
+// one, so long files and history are not read at once.
+func (s *session) run() {
+	defer s.stop()
+	if !s.fetchWord() {
+		return
+	}
+
+	// words go to history when user leaves them
+	var shown string
+	defer func() { s.remember(s.currentWord()) }()
+
+	replay := true
+	for {
+		if word := s.currentWord(); word != shown {
+			s.remember(shown)
+			shown = word
+		}
+		list := s.list()
+		if replay && len(list) > 0 {
+			s.played[shown] = list[s.pronIdx]
+			s.play(list[s.pronIdx])
+		}
+		s.draw()
+
+		key, ok := s.nextKey()
+		if !ok {
+			return
+		}
+		var quit bool
+		replay, quit = s.handle(key)
+		if quit {
+			return
+		}
+	}
+}
+
+// fetchWord adds the next word from the source to the session. Returns false
+// if the source has no more words.
+func (s *session) fetchWord() bool {
+	if s.eof {
+		return false
+	}
+	word, ok := s.source.Next()
+	if !ok {
+		// user can cancel the prompt and still enter words later
+		if _, isPrompt := s.source.(*promptSource); !isPrompt {
+			s.eof = true
+		}
+		return false
+	}
+	s.words = append(s.words, word)
+	return true
+}
+
+// currentWord returns the current word or empty string if there are no
+// words yet
+func (s *session) currentWord() string {
+	if len(s.words) == 0 {
+		return ""
+	}
+	return s.words[s.wordIdx]
+}
+
+// list returns pronunciations of the current word. Lists are loaded once
+// per session.
+func (s *session) list() []Pron {
+	word := s.words[s.wordIdx]
+	list, ok := s.lists[word]
+	if !ok {
+		s.setStatus(fmt.Sprintf("Loading `%s`...", word))
+		s.draw()
+		var searchPage string
+		list, searchPage = getPronListPage(s.cfg, word)
+		s.lists[word] = list
+		if len(list) == 0 {
+			s.setStatus(fmt.Sprintf("Looking for words similar to `%s`...", word))
+			s.draw()
+			known := append(append([]string{}, s.words...), s.history...)
+			s.suggestions[word] = suggestWords(s.cfg, word, searchPage, known)
+			s.setStatus(fmt.Sprintf("Can not get pronunciation for `%s`", word))
+		} else {
+			s.setStatus("")
+		}
+	}
+	if s.pronIdx >= len(list) && s.pronIdx >= len(s.suggestions[word]) {
+		s.pronIdx = 0
+	}
+	return list
+}
+
+// handle changes state of the session according to a pressed key. Returns
+// true if the current pronunciation has to be played again and true if user
+// wants to quit.
+func (s *session) handle(key string) (replay, quit bool) {
+	list := s.lists[s.words[s.wordIdx]]
+	// without pronunciations the same keys choose a suggested word
+	suggestions := s.suggestions[s.words[s.wordIdx]]
+	choices := len(list)
+	if choices == 0 {
+		choices = len(suggestions)
+	}
+	action := s.keymap.action(key)
+	if len(list) == 0 && len(suggestions) > 0 && s.keymap.bound(key, "accept_suggestion") {
+		return s.useSuggestion(suggestions[s.pronIdx])
+	}
+	// digits choose pronunciations unless they are bound to actions
+	if action == "" && key >= "0" && key <= "9" && len(key) == 1 && choices > 1 {
+		s.number += key
+		num, _ := strconv.Atoi(s.number)
+		digitsNum := len(strconv.Itoa(choices - 1))
+		switch {
+		case num > choices-1:
+			s.setStatus(fmt.Sprintf("Number %s is too big", s.number))
+			s.number = ""
+		case len(s.number) == digitsNum:
+			s.number = ""
+			if len(list) == 0 {
+				return s.useSuggestion(suggestions[num])
+			}
+			s.pronIdx = num
+			return true, false
+		default:
+			s.setStatus("Choose pronunciation: " + s.number)
+		}
+		return false, false
+	}
+	s.number = ""
+	s.setStatus("")
+
+	switch action {
+	case "quit":
+		return false, true
+	case "next_pron":
+		if s.pronIdx < choices-1 {
+			s.pronIdx++
+			return true, false
+		}
+	case "prev_pron":
+		if s.pronIdx > 0 {
+			s.pronIdx--
+			return true, false
+		}
+	case "next_word":
+		if s.wordIdx == len(s.words)-1 && !s.fetchWord() {
+			s.setStatus("This is the last word")
+			return false, false
+		}
+		s.wordIdx++
+		s.pronIdx = 0
+		return true, false
+	case "prev_word":
+		if s.wordIdx > 0 {
+			s.wordIdx--
+			s.pronIdx = 0
+			return true, false
+		}
+	case "replay":
+		return true, false
+	case "faster", "slower":
+		changeSpeed(s.cfg, action == "faster")
+		return true, false
+	case "retry":
+		delete(s.lists, s.words[s.wordIdx])
+		delete(s.suggestions, s.words[s.wordIdx])
+		return true, false
+	case "save":
+		if len(list) > 0 {
+			s.save(list[s.pronIdx])
+		}
+	case "star":
+		if len(list) > 0 {
+			s.star(list[s.pronIdx])
+		}
+	case "tag":
+		if len(list) > 0 {
+			s.tag(list[s.pronIdx])
+		}
+	case "compare":
+		if len(list) > 0 {
+			s.compare(list)
+		}
+	case "record":
+		if len(list) > 0 {
+			s.record(list[s.pronIdx])
+		}
+	case "new_word":
+		word := s.prompt("Enter a new word: ")
+		if word == "" {
+			return false, false
+		}
+		// the new word goes right after the current one
+		s.words = append(s.words[:s.wordIdx+1],
+			append([]string{word}, s.words[s.wordIdx+1:]...)...)
+		s.wordIdx++
+		s.pronIdx = 0
+		return true, false
+	}
+	return false, false
+}
+
+// save saves a pronunciation to the current directory even if downloading
+// is disabled
+func (s *session) save(item Pron) {
+	cfg := make(Config)
+	for key, value := range s.cfg {
+		cfg[key] = value
+	}
+	cfg["DOWNLOAD"] = "yes"
+	path, err := saveWord(cfg, item)
+	if err != nil {
+		s.setStatus(fmt.Sprintf("Can not save `%s`: %v", item.aFile, err))
+		return
+	}
+	if path != item.aFile {
+		s.setStatus(fmt.Sprintf("Can not save `%s`", item.aFile))
+		return
+	}
+	s.setStatus(fmt.Sprintf("Saved `%s`", item.aFile))
+}
+
+// star stars a pronunciation in the library or removes the star
+func (s *session) star(item Pron) {
+	status := "Starred"
+	if !s.library.toggleStar(s.cfg["LANG"], item) {
+		status = "Star removed"
+	}
+	if err := s.library.save(); err != nil {
+		status = err.Error()
+	}
+	s.setStatus(status)
+}
+
+// tag asks for tags separated by spaces and adds them to a pronunciation in
+// the library
+func (s *session) tag(item Pron) {
+	tags := strings.Fields(s.prompt("Tags: "))
+	if len(tags) == 0 {
+		return
+	}
+	s.library.tag(s.cfg["LANG"], item, tags)
+	status := "Tagged as " + strings.Join(tags, ", ")
+	if err := s.library.save(); err != nil {
+		status = err.Error()
+	}
+	s.setStatus(status)
+}
+
+// remember records a word with its last played pronunciation in history
+func (s *session) remember(word string) {
+	if word == "" {
+		return
+	}
+	if err := addHistory(s.cfg, word, s.played[word]); err != nil {
+		s.setStatus(err.Error())
+	}
+	recent := []string{word}
+	for _, w := range s.history {
+		if w != word {
+			recent = append(recent, w)
+		}
+	}
+	s.history = recent
+}
+
+// useSuggestion replaces the current word with a suggested one
+func (s *session) useSuggestion(word string) (replay, quit bool) {
+	s.words[s.wordIdx] = word
+	s.pronIdx = 0
+	return true, false
+}
+
+// compare plays one pronunciation of every country one after another
+func (s *session) compare(list []Pron) {
+	samples := accentSamples(list)
+	if len(samples) < 2 {
+		s.setStatus("All pronunciations are from " + list[0].country)
+		return
+	}
+	s.playAll(samples)
+}
+
+// accentSamples returns the first pronunciation of every country in order of
+// the list
+func accentSamples(list []Pron) []Pron {
+	var samples []Pron
+	seen := make(map[string]bool)
+	for _, item := range list {
+		if !seen[item.country] {
+			seen[item.country] = true
+			samples = append(samples, item)
+		}
+	}
+	return samples
+}
+
+// playSequence starts playback of pronunciations one after another stopping
+// the previous playback. The playing one is shown on the screen.
+func (s *session) playSequence(items []Pron) {
+	s.stop()
+	var paths []string
+	for _, item := range items {
+		path, err := playableFile(s.cfg, item)
+		if err != nil {
+			s.setStatus(err.Error())
+		}
+		paths = append(paths, path)
+	}
+	s.mu.Lock()
+	s.comparing, s.compareIdx = items, 0
+	s.mu.Unlock()
+	s.player = startSequence(s.cfg, paths, func(i int) {
+		s.mu.Lock()
+		if i < len(s.comparing) {
+			s.compareIdx = i
+		} else {
+			s.comparing = nil
+		}
+		s.mu.Unlock()
+		s.requestRedraw()
+	})
+}
+
+// playInBackground starts playback of a pronunciation stopping the previous
+// one
+func (s *session) playInBackground(item Pron) {
+	s.stop()
+	path, err := playableFile(s.cfg, item)
+	if err != nil {
+		s.setStatus(err.Error())
+		if path == "" {
+			return
+		}
+	}
+	s.player = startPlayback(s.cfg, path)
+}
+
+// stop interrupts current playback
+func (s *session) stop() {
+	if s.player != nil {
+		s.player.stop()
+		s.player = nil
+	}
+	s.mu.Lock()
+	s.comparing = nil
+	s.mu.Unlock()
+}
+
+// nextKey waits for a key. The key is read in background, so meanwhile the
+// screen is redrawn when background playback asks for it. A key is read only
+// when it is waited for, so nothing reads the terminal after the session.
+// Returns false if keys can not be read and the session has to end.
+func (s *session) nextKey() (string, bool) {
+	if s.err != nil {
+		return "", false
+	}
+	if s.keys == nil {
+		keys := make(chan keyPress, 1)
+		go func(readKey func() (string, error)) {
+			key, err := readKey()
+			keys <- keyPress{key, err}
+		}(s.readKey)
+		s.keys = keys
+	}
+	for {
+		select {
+		case press := <-s.keys:
+			s.keys = nil
+			s.err = press.err
+			return press.key, press.err == nil
+		case <-s.redraw:
+			s.draw()
+		}
+	}
+}
+
+// requestRedraw asks the main loop to draw the screen. Background goroutines
+// use it instead of draw.
+func (s *session) requestRedraw() {
+	select {
+	case s.redraw <- struct{}{}:
+	default:
+	}
+}
+
+// setStatus sets a message shown in the status bar
+func (s *session) setStatus(text string) {
+	s.mu.Lock()
+	s.status = text
+	s.mu.Unlock()
+}
+
+// prompt reads a line in the status bar with a line editor. Arrow keys up and
+// down recall words from history, Tab completes words from history and the
+// cache. Returns empty string if user cancels input with Esc or Ctrl-C.
+func (s *session) prompt(text string) string {
+	ed := newLineEditor(s.history, func(prefix string) []string {
+		return completeWord(append(s.history, cachedWords(s.cfg)...), prefix)
+	})
+	s.mu.Lock()
+	s.status = text
+	s.editor = ed
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.status = ""
+		s.editor = nil
+		s.mu.Unlock()
+	}()
+
+	for {
+		s.draw()
+		key, ok := s.nextKey()
+		if !ok {
+			return ""
+		}
+		s.mu.Lock()
+		done, cancel := ed.handle(key)
+		s.mu.Unlock()
+		switch {
+		case done:
+			return ed.String()
+		case cancel:
+			return ""
+		}
+	}
+}
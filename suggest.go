@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// maxSuggestions is how many similar words are offered for a word without
+// pronunciations, so every suggestion can be chosen with one digit
+const maxSuggestions = 10
+
+// suggestWords returns words similar to a word without pronunciations: words
+// found by Forvo search first, then words from the cache and known words
+// which are a typo away from it. searchPage is the search page of the word if
+// it is already fetched.
+func suggestWords(cfg Config, word, searchPage string, known []string) []string {
+	var result []string
+	seen := map[string]bool{strings.ToLower(word): true}
+	add := func(words []string) {
+		for _, w := range words {
+			if key := strings.ToLower(w); !seen[key] && len(result) < maxSuggestions {
+				seen[key] = true
+				result = append(result, w)
+			}
+		}
+	}
+	add(searchSuggestions(cfg, word, searchPage))
+	add(closeWords(word, append(cachedWords(cfg), known...)))
+	return result
+}
+
+// searchSuggestions returns words listed on the Forvo search page of a word.
+// The page is fetched if it is empty.
+func searchSuggestions(cfg Config, word, pageText string) []string {
+	if pageText == "" {
+		var err error
+		if pageText, err = getHTML(cfg, searchURL(cfg, word)); err != nil {
+			return nil
+		}
+	}
+
+	// every found word links to its pronunciation page
+	linkStr := `(?is)<a[^>]*href="[^"]*/word/([^/"]+)/#` +
+		regexp.QuoteMeta(cfg["LANG"]) + `"`
+	linkRe := regexp.MustCompile(linkStr)
+	var result []string
+	for _, match := range linkRe.FindAllStringSubmatch(pageText, -1) {
+		w, err := url.PathUnescape(match[1])
+		if err != nil {
+			continue
+		}
+		result = append(result, strings.ReplaceAll(w, "_", " "))
+	}
+	return result
+}
+
+// cachedWords returns words of the current language which have pronunciation
+// lists in the cache
+func cachedWords(cfg Config) []string {
+	if cfg["CACHE_DIR"] == "" {
+		return nil
+	}
+	files, _ := filepath.Glob(filepath.Join(cfg["CACHE_DIR"], cacheIndexDir,
+		cfg["LANG"], "*", "*.json"))
+	var result []string
+	for _, file := range files {
+		word, err := url.PathUnescape(strings.TrimSuffix(filepath.Base(file), ".json"))
+		if err == nil {
+			result = append(result, word)
+		}
+	}
+	return result
+}
+
+// closeWords returns candidates which differ from word by a typo: one edit
+// for short words and two edits for longer ones. The closest words go first.
+func closeWords(word string, candidates []string) []string {
+	limit := 1
+	if len([]rune(word)) > 4 {
+		limit = 2
+	}
+	distances := make(map[string]int)
+	var result []string
+	for _, c := range candidates {
+		if _, ok := distances[c]; ok {
+			continue
+		}
+		d := editDistance(word, c)
+		distances[c] = d
+		if d > 0 && d <= limit {
+			result = append(result, c)
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		if distances[result[i]] != distances[result[j]] {
+			return distances[result[i]] < distances[result[j]]
+		}
+		return result[i] < result[j]
+	})
+	return result
+}
+
+// editDistance returns number of insertions, deletions, substitutions and
+// transpositions of adjacent letters needed to change a into b ignoring case
+func editDistance(a, b string) int {
+	ra := []rune(strings.ToLower(a))
+	rb := []rune(strings.ToLower(b))
+	d := make([][]int, len(ra)+1)
+	for i := range d {
+		d[i] = make([]int, len(rb)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			d[i][j] = d[i-1][j-1] + cost
+			if d[i-1][j]+1 < d[i][j] {
+				d[i][j] = d[i-1][j] + 1
+			}
+			if d[i][j-1]+1 < d[i][j] {
+				d[i][j] = d[i][j-1] + 1
+			}
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] &&
+				d[i-2][j-2]+1 < d[i][j] {
+				d[i][j] = d[i-2][j-2] + 1
+			}
+		}
+	}
+	return d[len(ra)][len(rb)]
+}
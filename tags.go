@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"unicode/utf16"
+)
+
+type audioTags struct {
+	title, artist, album, comment string
+}
+
+// vorbisTagNames are Vorbis comment field names we overwrite
+var vorbisTagNames = []string{"TITLE", "ARTIST", "ALBUM", "COMMENT"}
+
+// pronTags returns tags describing a pronunciation
+func pronTags(cfg Config, item Pron) audioTags {
+	return audioTags{
+		title:  item.word,
+		artist: item.author,
+		album:  cfg["LANG"],
+		comment: fmt.Sprintf("%s, %s, %s/word/%s/#%s", item.country, item.sex,
+			forvoURL, item.word, cfg["LANG"]),
+	}
+}
+
+// tagAudio writes tags of a pronunciation into a saved audio file. Format is
+// taken from the file extension.
+func tagAudio(cfg Config, item Pron, path string) error {
+	if cfg["TAGS"] != "yes" {
+		return nil
+	}
+	if cfg["VERBOSE"] == "yes" {
+		fmt.Printf("Write tags: `%s`\n", path)
+	}
+
+	tags := pronTags(cfg, item)
+	var err error
+	switch filepath.Ext(path) {
+	case ".mp3":
+		err = rewriteFile(path, func(data []byte) ([]byte, error) {
+			return writeID3(data, tags), nil
+		})
+	case ".ogg", ".opus":
+		err = rewriteFile(path, func(data []byte) ([]byte, error) {
+			return writeOggComments(data, tags)
+		})
+	case ".flac":
+		err = rewriteFile(path, func(data []byte) ([]byte, error) {
+			return writeFlacComments(data, tags)
+		})
+	case ".wav":
+		err = rewriteFile(path, func(data []byte) ([]byte, error) {
+			return writeWavInfo(data, tags)
+		})
+	case ".m4a":
+		err = ffmpegTags(path, tags)
+	}
+	if err != nil {
+		return fmt.Errorf("can not write tags to %s: %v", path, err)
+	}
+	return nil
+}
+
+// rewriteFile replaces content of a file with the result of fn
+func rewriteFile(path string, fn func(data []byte) ([]byte, error)) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	data, err = fn(data)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// writeID3 replaces ID3v2 tag of mp3 data with a new ID3v2.3 tag
+func writeID3(data []byte, tags audioTags) []byte {
+	if len(data) >= 10 && string(data[0:3]) == "ID3" {
+		size := 10 + (int(data[6])<<21 | int(data[7])<<14 | int(data[8])<<7 |
+			int(data[9]))
+		if data[5]&0x10 != 0 {
+			// ID3v2.4 footer
+			size += 10
+		}
+		if size > len(data) {
+			size = len(data)
+		}
+		data = data[size:]
+	}
+
+	var frames bytes.Buffer
+	id3Frame(&frames, "TIT2", id3Text(tags.title))
+	id3Frame(&frames, "TPE1", id3Text(tags.artist))
+	id3Frame(&frames, "TALB", id3Text(tags.album))
+	// comment frame: encoding, language, empty description, text
+	comm := []byte{1}
+	comm = append(comm, "eng"...)
+	comm = append(comm, id3UTF16("")...)
+	comm = append(comm, 0, 0)
+	comm = append(comm, id3UTF16(tags.comment)...)
+	id3Frame(&frames, "COMM", comm)
+
+	size := frames.Len()
+	header := []byte{'I', 'D', '3', 3, 0, 0,
+		byte(size >> 21 & 0x7f), byte(size >> 14 & 0x7f),
+		byte(size >> 7 & 0x7f), byte(size & 0x7f)}
+	result := append(header, frames.Bytes()...)
+	return append(result, data...)
+}
+
+// id3Frame writes ID3v2.3 frame
+func id3Frame(buf *bytes.Buffer, id string, body []byte) {
+	buf.WriteString(id)
+	binary.Write(buf, binary.BigEndian, uint32(len(body)))
+	buf.Write([]byte{0, 0})
+	buf.Write(body)
+}
+
+// id3Text returns body of ID3 text frame encoded as UTF-16
+func id3Text(s string) []byte {
+	return append([]byte{1}, id3UTF16(s)...)
+}
+
+// id3UTF16 encodes string as UTF-16 with byte order mark
+func id3UTF16(s string) []byte {
+	result := []byte{0xff, 0xfe}
+	for _, c := range utf16.Encode([]rune(s)) {
+		result = append(result, byte(c), byte(c>>8))
+	}
+	return result
+}
+
+// parseVorbisComment parses Vorbis comment structure without framing bit
+func parseVorbisComment(data []byte) (string, []string, error) {
+	broken := errors.New("broken vorbis comment")
+	if len(data) < 4 {
+		return "", nil, broken
+	}
+	size := int(binary.LittleEndian.Uint32(data))
+	if 4+size > len(data) {
+		return "", nil, broken
+	}
+	vendor := string(data[4 : 4+size])
+	pos := 4 + size
+	if pos+4 > len(data) {
+		return "", nil, broken
+	}
+	count := int(binary.LittleEndian.Uint32(data[pos:]))
+	pos += 4
+	var comments []string
+	for i := 0; i < count; i++ {
+		if pos+4 > len(data) {
+			return "", nil, broken
+		}
+		size = int(binary.LittleEndian.Uint32(data[pos:]))
+		pos += 4
+		if pos+size > len(data) {
+			return "", nil, broken
+		}
+		comments = append(comments, string(data[pos:pos+size]))
+		pos += size
+	}
+	return vendor, comments, nil
+}
+
+// encodeVorbisComment builds Vorbis comment structure without framing bit.
+// Comments with our tag names are replaced by the new tags.
+func encodeVorbisComment(vendor string, comments []string, tags audioTags) []byte {
+	var kept []string
+	for _, c := range comments {
+		name := strings.ToUpper(strings.SplitN(c, "=", 2)[0])
+		replaced := false
+		for _, tagName := range vorbisTagNames {
+			if name == tagName {
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			kept = append(kept, c)
+		}
+	}
+	kept = append(kept, "TITLE="+tags.title, "ARTIST="+tags.artist,
+		"ALBUM="+tags.album, "COMMENT="+tags.comment)
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, uint32(len(vendor)))
+	buf.WriteString(vendor)
+	binary.Write(&buf, binary.LittleEndian, uint32(len(kept)))
+	for _, c := range kept {
+		binary.Write(&buf, binary.LittleEndian, uint32(len(c)))
+		buf.WriteString(c)
+	}
+	return buf.Bytes()
+}
+
+// writeFlacComments replaces VORBIS_COMMENT metadata block of flac data
+func writeFlacComments(data []byte, tags audioTags) ([]byte, error) {
+	if len(data) < 4 || string(data[0:4]) != "fLaC" {
+		return nil, errors.New("not a flac file")
+	}
+	const streamInfo, comment = 0, 4
+
+	var blocks [][]byte
+	vendor, comments := "tellme-go", []string(nil)
+	pos := 4
+	for last := false; !last; {
+		if pos+4 > len(data) {
+			return nil, errors.New("broken flac metadata")
+		}
+		last = data[pos]&0x80 != 0
+		btype := data[pos] & 0x7f
+		size := int(data[pos+1])<<16 | int(data[pos+2])<<8 | int(data[pos+3])
+		if pos+4+size > len(data) {
+			return nil, errors.New("broken flac metadata")
+		}
+		body := data[pos+4 : pos+4+size]
+		pos += 4 + size
+
+		if btype == comment {
+			var err error
+			vendor, comments, err = parseVorbisComment(body)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		blocks = append(blocks, append([]byte{btype}, body...))
+		if btype == streamInfo {
+			// comment block goes right after STREAMINFO
+			blocks = append(blocks, nil)
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("fLaC")
+	for i, block := range blocks {
+		if block == nil {
+			block = append([]byte{comment},
+				encodeVorbisComment(vendor, comments, tags)...)
+		}
+		header := block[0]
+		if i == len(blocks)-1 {
+			header |= 0x80
+		}
+		size := len(block) - 1
+		buf.Write([]byte{header, byte(size >> 16), byte(size >> 8), byte(size)})
+		buf.Write(block[1:])
+	}
+	buf.Write(data[pos:])
+	return buf.Bytes(), nil
+}
+
+// writeWavInfo replaces LIST/INFO chunk of wav data
+func writeWavInfo(data []byte, tags audioTags) ([]byte, error) {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		return nil, errors.New("not a wav file")
+	}
+
+	var buf bytes.Buffer
+	buf.Write(data[0:12])
+	for pos := 12; pos+8 <= len(data); {
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		end := pos + 8 + size + size%2
+		if end > len(data) {
+			end = len(data)
+		}
+		if string(data[pos:pos+4]) != "LIST" || size < 4 ||
+			string(data[pos+8:pos+12]) != "INFO" {
+			buf.Write(data[pos:end])
+		}
+		pos = end
+	}
+
+	var info bytes.Buffer
+	info.WriteString("INFO")
+	for _, field := range []struct{ id, value string }{
+		{"INAM", tags.title},
+		{"IART", tags.artist},
+		{"IPRD", tags.album},
+		{"ICMT", tags.comment},
+	} {
+		value := append([]byte(field.value), 0)
+		info.WriteString(field.id)
+		binary.Write(&info, binary.LittleEndian, uint32(len(value)))
+		info.Write(value)
+		if len(value)%2 == 1 {
+			info.WriteByte(0)
+		}
+	}
+	buf.WriteString("LIST")
+	binary.Write(&buf, binary.LittleEndian, uint32(info.Len()))
+	buf.Write(info.Bytes())
+
+	result := buf.Bytes()
+	binary.LittleEndian.PutUint32(result[4:], uint32(len(result)-8))
+	return result, nil
+}
+
+// ffmpegTags writes tags with ffmpeg. Files are left untagged if ffmpeg is
+// not installed.
+func ffmpegTags(path string, tags audioTags) error {
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		return nil
+	}
+	tmp := strings.TrimSuffix(path, filepath.Ext(path)) + ".tmp" + filepath.Ext(path)
+	out, err := exec.Command("ffmpeg", "-y", "-loglevel", "error", "-i", path,
+		"-c", "copy",
+		"-metadata", "title="+tags.title,
+		"-metadata", "artist="+tags.artist,
+		"-metadata", "album="+tags.album,
+		"-metadata", "comment="+tags.comment,
+		tmp).CombinedOutput()
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return os.Rename(tmp, path)
+}
@@ -4,5 +4,9 @@ import "os"
 
 func main() {
 	cfg := configInit()
+	if cfg["COMMAND"] != "" {
+		runCommand(cfg, os.Args)
+		return
+	}
 	mainLoop(cfg, os.Args)
 }
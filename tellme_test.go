@@ -1,15 +1,24 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/md5"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"math/rand"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
+	"regexp"
 	"strings"
 	"testing"
+	"time"
+	"unicode/utf8"
 )
 
 func getDefaults() []configFileValue {
@@ -141,6 +150,10 @@ func TestUpdateFromConfigFile(t *testing.T) {
 			name: "Nonexisted option",
 			key:  "NONEXISTED",
 			val:  "val_new",
+		}, {
+			name: "Option with spaces",
+			key:  "COMMAND",
+			val:  "mpv --speed=1 {file}",
 		},
 	}
 
@@ -168,6 +181,7 @@ func TestUpdateFromConfigFile(t *testing.T) {
 	fmt.Fprintln(f, "NONCHANGED=val")
 	fmt.Fprintln(f, "CHANGED=val_new")
 	fmt.Fprintln(f, "NONEXISTED=val_new")
+	fmt.Fprintln(f, "COMMAND=mpv --speed=1 {file} ")
 	err = f.Close()
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
@@ -177,6 +191,7 @@ func TestUpdateFromConfigFile(t *testing.T) {
 	cfg := make(Config)
 	cfg["NONCHANGED"] = "val"
 	cfg["CHANGED"] = "val"
+	cfg["COMMAND"] = ""
 
 	t.Run("Fails on nonexisted option", func(t *testing.T) {
 		if os.Getenv("BE_CRASHER") == "1" {
@@ -250,6 +265,27 @@ func TestUpdateFromCmdLine(t *testing.T) {
 	copy(os.Args, tmp)
 }
 
+func TestExtractCommand(t *testing.T) {
+	defer func(args []string) { os.Args = args }(os.Args)
+	for _, c := range []struct {
+		args []string
+		cmd  string
+		rest []string
+	}{
+		{[]string{"test", "cache", "export", "a.zip"}, "cache export", []string{"a.zip"}},
+		{[]string{"test", "quiz", "-n", "5"}, "quiz", []string{"-n", "5"}},
+		{[]string{"test", "cat", "history"}, "", []string{"cat", "history"}},
+		{[]string{"test", "--", "quiz"}, "", []string{"--", "quiz"}},
+	} {
+		os.Args = append([]string{}, c.args...)
+		cmd := extractCommand()
+		if cmd != c.cmd || !reflect.DeepEqual(os.Args[1:], c.rest) {
+			t.Errorf("extractCommand() with %q == %q, %q; expected %q, %q",
+				c.args, cmd, os.Args[1:], c.cmd, c.rest)
+		}
+	}
+}
+
 func TestPronCheck(t *testing.T) {
 	cfg := make(Config)
 	cfg["VERBOSE"] = "no"
@@ -257,12 +293,12 @@ func TestPronCheck(t *testing.T) {
 	getHTML = getTestURL
 
 	t.Run("Pronunciation found", func(t *testing.T) {
-		if pronCheck(cfg, "test") == false {
+		if found, _ := pronCheck(cfg, "test"); !found {
 			t.Errorf("Pronunciation for word `test` is not found")
 		}
 	})
 	t.Run("Pronunciation does not found", func(t *testing.T) {
-		if pronCheck(cfg, "tafel") == true {
+		if found, _ := pronCheck(cfg, "tafel"); found {
 			t.Errorf("Pronunciation for word `tafel` should not be found")
 		}
 	})
@@ -278,6 +314,7 @@ func TestGetPronList(t *testing.T) {
 			pron: []Pron{
 				Pron{
 					word:       "test",
+					id:         "test",
 					author:     "Author1",
 					sex:        "male",
 					country:    "United Kingdom",
@@ -286,34 +323,36 @@ func TestGetPronList(t *testing.T) {
 					aFile:      "test.mp3",
 					aURL:       audioURL + "/mp3/test.mp3",
 					fullAuthor: "Author1 (male from United Kingdom)",
-					cacheDir:   "mp3/en/09",
-					cacheFile:  "mp3/en/09/test_Author1.mp3",
+					cacheDir:   "audio/mp3/09",
+					cacheFile:  "audio/mp3/09/test.mp3",
 				},
 				Pron{
 					word:       "test",
+					id:         "test_2",
 					author:     "Author2",
 					sex:        "male",
 					country:    "Unknown",
-					mp3:        "https://audio00.forvo.com/audios/mp3/test.mp3",
-					ogg:        "https://audio00.forvo.com/audios/ogg/test.ogg",
+					mp3:        "https://audio00.forvo.com/audios/mp3/test_2.mp3",
+					ogg:        "https://audio00.forvo.com/audios/ogg/test_2.ogg",
 					aFile:      "test.mp3",
-					aURL:       "https://audio00.forvo.com/audios/mp3/test.mp3",
+					aURL:       "https://audio00.forvo.com/audios/mp3/test_2.mp3",
 					fullAuthor: "Author2 (male from Unknown)",
-					cacheDir:   "mp3/en/09",
-					cacheFile:  "mp3/en/09/test_Author2.mp3",
+					cacheDir:   "audio/mp3/b9",
+					cacheFile:  "audio/mp3/b9/test_2.mp3",
 				},
 				Pron{
 					word:       "test",
+					id:         "test_3",
 					author:     "Author3",
 					sex:        "male",
 					country:    "USA",
-					mp3:        "https://audio00.forvo.com/audios/mp3/test.mp3",
-					ogg:        "https://audio00.forvo.com/audios/ogg/test.ogg",
+					mp3:        "https://audio00.forvo.com/audios/mp3/test_3.mp3",
+					ogg:        "https://audio00.forvo.com/audios/ogg/test_3.ogg",
 					aFile:      "test.mp3",
-					aURL:       "https://audio00.forvo.com/audios/mp3/test.mp3",
+					aURL:       "https://audio00.forvo.com/audios/mp3/test_3.mp3",
 					fullAuthor: "Author3 (male from USA)",
-					cacheDir:   "mp3/en/09",
-					cacheFile:  "mp3/en/09/test_Author3.mp3",
+					cacheDir:   "audio/mp3/d5",
+					cacheFile:  "audio/mp3/d5/test_3.mp3",
 				},
 			},
 		},
@@ -341,6 +380,9 @@ func pronCompare(t *testing.T, i int, want, got Pron) {
 	if want.word != got.word {
 		t.Errorf("list[%d].word == '%s'; expected '%s'", i, got.word, want.word)
 	}
+	if want.id != got.id {
+		t.Errorf("list[%d].id == '%s'; expected '%s'", i, got.id, want.id)
+	}
 	if want.author != got.author {
 		t.Errorf("list[%d].author == '%s'; expected '%s'", i, got.author, want.author)
 	}
@@ -399,7 +441,9 @@ func TestSaveWord(t *testing.T) {
 
 	list := getPronList(cfg, "test")
 	list[0].aFile = filepath.Join(tmpDir, "test.mp3")
-	saveWord(cfg, list[0])
+	if _, err = saveWord(cfg, list[0]); err != nil {
+		t.Fatal(err)
+	}
 
 	gotFile, err := os.Open(list[0].aFile)
 	if err != nil {
@@ -419,3 +463,1809 @@ func TestSaveWord(t *testing.T) {
 		}
 	}
 }
+
+func TestCacheIndex(t *testing.T) {
+	cfg := make(Config)
+	cfg["VERBOSE"] = "no"
+	cfg["CACHE"] = "yes"
+	cfg["CACHE_DIR"] = t.TempDir()
+	cfg["LANG"] = "en"
+	cfg["ATYPE"] = "mp3"
+	cfg["PRONUNCIATION_CHECK"] = "no"
+	getHTML = getTestURL
+
+	list := getPronList(cfg, "test")
+	cached := cachedPronList(cfg, "test")
+	if len(cached) != len(list) {
+		t.Fatalf("len(cached) == %d; expected %d", len(cached), len(list))
+	}
+	for i := range list {
+		pronCompare(t, i, list[i], cached[i])
+	}
+
+	if cachedPronList(cfg, "cat") != nil {
+		t.Errorf("Word `cat` should not be in cache index")
+	}
+
+	bucket := filepath.Join(cfg["CACHE_DIR"], cacheIndexDir, "en", hashBucket("../../a/b"))
+	if path := indexPath(cfg, "en", "../../a/b"); filepath.Dir(path) != bucket {
+		t.Errorf("Index file %s should be in %s", path, bucket)
+	}
+	if err := writeIndex(cfg, "a/b c", list); err != nil {
+		t.Fatal(err)
+	}
+	if words := cachedWords(cfg); !reflect.DeepEqual(words, []string{"a/b c", "test"}) &&
+		!reflect.DeepEqual(words, []string{"test", "a/b c"}) {
+		t.Errorf("cachedWords() == %q; expected test and `a/b c`", words)
+	}
+}
+
+func TestLegacyCacheMigration(t *testing.T) {
+	cfg := make(Config)
+	cfg["VERBOSE"] = "no"
+	cfg["CACHE"] = "yes"
+	cfg["CACHE_DIR"] = t.TempDir()
+	cfg["LANG"] = "en"
+	cfg["ATYPE"] = "mp3"
+	cfg["PRONUNCIATION_CHECK"] = "no"
+	getHTML = getTestURL
+	getAudio = func(cfg Config, url, dst string) error {
+		t.Errorf("Audio file should be taken from legacy cache, not downloaded")
+		return nil
+	}
+
+	list := getPronList(cfg, "cat")
+	legacy := legacyCacheFile(cfg, list[0])
+	if err := os.MkdirAll(filepath.Dir(legacy), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := copyFile(cfg, "local_files/forvo_en_cat.mp3", legacy); err != nil {
+		t.Fatal(err)
+	}
+
+	path, err := cacheAudio(cfg, list[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != list[0].cacheFile {
+		t.Errorf("cacheAudio() == '%s'; expected '%s'", path, list[0].cacheFile)
+	}
+	if _, err := os.Stat(list[0].cacheFile); err != nil {
+		t.Errorf("Migrated file is missing: %s", err)
+	}
+	if _, err := os.Stat(legacy); err == nil {
+		t.Errorf("Legacy file %s should be moved", legacy)
+	}
+}
+
+func TestCacheExportImport(t *testing.T) {
+	cfg := make(Config)
+	cfg["VERBOSE"] = "no"
+	cfg["CACHE"] = "yes"
+	cfg["CACHE_DIR"] = t.TempDir()
+	cfg["LANG"] = "en"
+	cfg["ATYPE"] = "mp3"
+	cfg["PRONUNCIATION_CHECK"] = "no"
+	getHTML = getTestURL
+	getAudio = downloadTestFile
+
+	for _, word := range []string{"cat", "dog"} {
+		list := getPronList(cfg, word)
+		if _, err := cacheAudio(cfg, list[0]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, valid := range map[string]bool{"cache.tgz": true, "out.tar": false, "out.rar": false} {
+		if err := checkArchiveName(name); (err == nil) != valid {
+			t.Errorf("checkArchiveName(%s) == %v", name, err)
+		}
+	}
+
+	for _, archive := range []string{"cache.tar.gz", "cache.zip"} {
+		t.Run(archive, func(t *testing.T) {
+			archive = filepath.Join(t.TempDir(), archive)
+			cacheExport(cfg, []string{archive, "cat"})
+
+			newCfg := make(Config)
+			for k, v := range cfg {
+				newCfg[k] = v
+			}
+			newCfg["CACHE_DIR"] = t.TempDir()
+
+			var stats importStats
+			err := walkArchive(archive, func(name string, r io.Reader) error {
+				return importCacheFile(newCfg, name, r, &stats)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.added != 2 {
+				t.Errorf("stats.added == %d; expected 2", stats.added)
+			}
+
+			list := cachedPronList(newCfg, "cat")
+			if len(list) != 3 {
+				t.Fatalf("len(cachedPronList()) == %d; expected 3", len(list))
+			}
+			if _, err := os.Stat(list[0].cacheFile); err != nil {
+				t.Errorf("Imported audio file is missing: %s", err)
+			}
+			if cachedPronList(newCfg, "dog") != nil {
+				t.Errorf("Word `dog` should not be exported")
+			}
+
+			stats = importStats{}
+			walkArchive(archive, func(name string, r io.Reader) error {
+				return importCacheFile(newCfg, name, r, &stats)
+			})
+			if stats.identical != 2 || stats.added != 0 {
+				t.Errorf("Second import: %+v; expected 2 identical files", stats)
+			}
+		})
+	}
+}
+
+func TestMergeIndex(t *testing.T) {
+	old := []byte(`{"word":"cat","lang":"en","entries":[{"id":"a"},{"id":"b"}]}`)
+	data := []byte(`{"word":"cat","lang":"en","entries":[{"id":"c"},{"id":"a"}]}`)
+	merged, err := mergeIndex(old, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var idx cacheIndex
+	if err = json.Unmarshal(merged, &idx); err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, e := range idx.Entries {
+		ids = append(ids, e.ID)
+	}
+	if strings.Join(ids, ",") != "a,b,c" {
+		t.Errorf("Merged ids == %v; expected [a b c]", ids)
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	cfg := make(Config)
+	cfg["VERBOSE"] = "no"
+	cfg["CACHE"] = "no"
+	cfg["DOWNLOAD"] = "yes"
+	cfg["CACHE_DIR"] = t.TempDir()
+	cfg["LANG"] = "en"
+	cfg["ATYPE"] = "mp3"
+	cfg["PRONUNCIATION_CHECK"] = "no"
+	cfg["PREFETCH_TOP"] = "1"
+	getHTML = getTestURL
+	getAudio = downloadTestFile
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefetch(cfg, []string{"cat", "dog"})
+
+	if _, err := os.Stat(filepath.Join(wd, "cat.mp3")); err == nil {
+		os.Remove(filepath.Join(wd, "cat.mp3"))
+		t.Errorf("Prefetch should not save files in current directory")
+	}
+	for _, word := range []string{"cat", "dog"} {
+		list := cachedPronList(cfg, word)
+		if len(list) == 0 {
+			t.Fatalf("Word `%s` is not in cache index", word)
+		}
+		if _, err := os.Stat(list[0].cacheFile); err != nil {
+			t.Errorf("Audio for `%s` is not cached: %s", word, err)
+		}
+	}
+
+	getHTML = func(cfg Config, url string) (string, error) {
+		t.Errorf("Cached word should not be downloaded again: %s", url)
+		return "", errors.New("unexpected download")
+	}
+	if list := getPronList(cfg, "cat"); len(list) != 3 {
+		t.Errorf("len(getPronList()) == %d; expected 3", len(list))
+	}
+}
+
+func TestDecodeAudio(t *testing.T) {
+	audio, err := decodeAudio("local_files/forvo_en_cat.mp3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if audio.rate == 0 || audio.channels != 2 {
+		t.Errorf("rate == %d, channels == %d; expected stereo audio with non-zero rate",
+			audio.rate, audio.channels)
+	}
+	if audio.duration() <= 0 {
+		t.Errorf("duration() == %v; expected positive value", audio.duration())
+	}
+	for i, v := range audio.samples {
+		if v < -1 || v > 1 {
+			t.Fatalf("samples[%d] == %f; expected value in [-1, 1]", i, v)
+		}
+	}
+
+	if _, err := decodeAudio("local_files/forvo_en_cat.html"); err == nil {
+		t.Errorf("Decoding of unknown format should fail")
+	}
+}
+
+func TestPlayerArgs(t *testing.T) {
+	tests := []struct {
+		name   string
+		player string
+		path   string
+		want   []string
+	}{
+		{
+			name:   "Preset",
+			player: "mpg123",
+			path:   "cat.mp3",
+			want:   []string{"mpg123", "-q", "cat.mp3"},
+		}, {
+			name:   "Template",
+			player: "ffplay -nodisp '{file}'",
+			path:   "my cat.ogg",
+			want:   []string{"ffplay", "-nodisp", "my cat.ogg"},
+		}, {
+			name:   "Without placeholder",
+			player: "paplay --volume=30000",
+			path:   "cat.ogg",
+			want:   []string{"paplay", "--volume=30000", "cat.ogg"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := playerArgs(tt.player, tt.path, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("playerArgs() == %q; expected %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlayerFor(t *testing.T) {
+	defer func(f func() bool) { soundServer = f }(soundServer)
+	soundServer = func() bool { return true }
+	cfg := make(Config)
+	cfg["PLAYER"] = "mpg123"
+	cfg["PLAYER_MP3"] = ""
+	cfg["PLAYER_OGG"] = ""
+
+	if got := playerFor(cfg, "cat.mp3"); got != "mpg123" {
+		t.Errorf("playerFor(mp3) == %s; expected mpg123", got)
+	}
+	if got := playerFor(cfg, "cat.ogg"); got != "native" {
+		t.Errorf("playerFor(ogg) == %s; expected native", got)
+	}
+	cfg["PLAYER_OGG"] = "ogg123 {file}"
+	if got := playerFor(cfg, "cat.ogg"); got != "ogg123 {file}" {
+		t.Errorf("playerFor(ogg) == %s; expected ogg123 {file}", got)
+	}
+
+	// without sound server an installed external player is used
+	soundServer = func() bool { return false }
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "ffplay"), []byte("#!/bin/sh\n"), 0750)
+	t.Setenv("PATH", dir)
+	cfg["PLAYER"] = "auto"
+	cfg["PLAYER_OGG"] = ""
+	if got := playerFor(cfg, "cat.ogg"); got != "ffplay" {
+		t.Errorf("playerFor(ogg) == %s; expected ffplay", got)
+	}
+	// the built-in player is not used for formats it can not decode
+	soundServer = func() bool { return true }
+	if got := playerFor(cfg, "cat.m4a"); got != "ffplay" {
+		t.Errorf("playerFor(m4a) == %s; expected ffplay", got)
+	}
+	cfg["PLAYER"] = "native"
+	if got := playerFor(cfg, "cat.opus"); got != "ffplay" {
+		t.Errorf("native playerFor(opus) == %s; expected ffplay", got)
+	}
+	soundServer = func() bool { return false }
+	cfg["PLAYER"] = "mpg123"
+	cfg["SPEED"] = "1.5"
+	if got := playerFor(cfg, "cat.mp3"); got != "ffplay" {
+		t.Errorf("playerFor(mp3) at speed 1.5 == %s; expected ffplay", got)
+	}
+	t.Setenv("PATH", "")
+	if got := playerFor(cfg, "cat.mp3"); got != "mpg123" {
+		t.Errorf("playerFor(mp3) without players == %s; expected mpg123", got)
+	}
+}
+
+func TestSayWordMissingPlayer(t *testing.T) {
+	cfg := make(Config)
+	cfg["PLAYER"] = "tellme-no-such-player {file}"
+	err := sayWord(cfg, "local_files/forvo_en_cat.mp3")
+	if err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("sayWord() == %v; expected `not found` error", err)
+	}
+
+	cfg["PLAYER"] = "true"
+	if err = sayWord(cfg, "local_files/forvo_en_cat.mp3"); err != nil {
+		t.Errorf("sayWord() == %v; expected nil", err)
+	}
+}
+
+func TestStretch(t *testing.T) {
+	audio, err := decodeAudio("local_files/forvo_en_dog.mp3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, speed := range []float64{0.5, 0.8, 1.5} {
+		got := audio.stretch(speed)
+		want := float64(audio.frames()) / speed
+		ratio := float64(got.frames()) / want
+		if ratio < 0.9 || ratio > 1.1 {
+			t.Errorf("stretch(%.1f) gives %d frames; expected about %.0f",
+				speed, got.frames(), want)
+		}
+		if got.rate != audio.rate || got.channels != audio.channels {
+			t.Errorf("stretch(%.1f) changed audio format", speed)
+		}
+	}
+}
+
+func TestChangeSpeed(t *testing.T) {
+	cfg := make(Config)
+	cfg["SPEED"] = "1.0"
+	changeSpeed(cfg, false)
+	changeSpeed(cfg, false)
+	if cfg["SPEED"] != "0.8" {
+		t.Errorf("cfg[SPEED] == %s; expected 0.8", cfg["SPEED"])
+	}
+	for i := 0; i < 20; i++ {
+		changeSpeed(cfg, true)
+	}
+	if cfg["SPEED"] != "2.0" {
+		t.Errorf("cfg[SPEED] == %s; expected 2.0", cfg["SPEED"])
+	}
+}
+
+func TestSayWordRepeat(t *testing.T) {
+	log := filepath.Join(t.TempDir(), "played")
+	cfg := make(Config)
+	cfg["PLAYER"] = "sh -c 'echo {speed} >> " + log + "'"
+	cfg["SPEED"] = "0.7"
+	cfg["REPEAT"] = "3"
+	cfg["REPEAT_GAP"] = "0"
+	if err := sayWord(cfg, "local_files/forvo_en_cat.mp3"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "0.7\n0.7\n0.7\n" {
+		t.Errorf("Player calls: %q; expected 3 calls with speed 0.7", data)
+	}
+}
+
+func TestPlaybackStop(t *testing.T) {
+	cfg := make(Config)
+	cfg["PLAYER"] = "sh -c 'sleep 5'"
+	cfg["REPEAT"] = "2"
+	cfg["REPEAT_GAP"] = "0"
+
+	start := time.Now()
+	player := startPlayback(cfg, "local_files/forvo_en_cat.mp3")
+	time.Sleep(100 * time.Millisecond)
+	player.stop()
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Playback was stopped after %v; expected immediately", elapsed)
+	}
+}
+
+func TestPlaybackSequence(t *testing.T) {
+	log := filepath.Join(t.TempDir(), "played")
+	cfg := make(Config)
+	cfg["PLAYER"] = "sh -c 'echo {file} >> " + log + "'"
+	cfg["REPEAT"] = "1"
+
+	var started []int
+	player := startSequence(cfg, []string{"a.mp3", "b.mp3"}, func(i int) {
+		started = append(started, i)
+	})
+	<-player.done
+	data, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "a.mp3\nb.mp3\n" || !reflect.DeepEqual(started, []int{0, 1, 2}) {
+		t.Errorf("Player calls: %q, started %v; expected a.mp3 and b.mp3", data, started)
+	}
+}
+
+func TestRecord(t *testing.T) {
+	dir := t.TempDir()
+	log := filepath.Join(dir, "played")
+	cfg := make(Config)
+	cfg["VERBOSE"] = "no"
+	cfg["CACHE"] = "yes"
+	cfg["CACHE_DIR"] = filepath.Join(dir, "cache")
+	cfg["LANG"] = "en"
+	cfg["ATYPE"] = "mp3"
+	cfg["PRONUNCIATION_CHECK"] = "no"
+	cfg["PLAYER"] = "sh -c 'echo {file} >> " + log + "'"
+	cfg["RECORDER"] = "sh -c 'echo {seconds} > {file}'"
+	getHTML = getTestURL
+	getAudio = downloadTestFile
+
+	s, _ := scriptedSession(cfg, nil, nil)
+	item := getPronList(cfg, "cat")[0]
+	s.record(item)
+	if s.player == nil {
+		t.Fatalf("Nothing is played: %s", s.status)
+	}
+	<-s.player.done
+
+	file := recordingPath(item)
+	if filepath.Dir(file) != item.cacheDir {
+		t.Errorf("Recording %s should be next to the cached audio %s", file, item.cacheFile)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seconds := fmt.Sprintln(recordTime(item.cacheFile)); string(data) != seconds {
+		t.Errorf("Recorded %q; expected %q seconds", data, seconds)
+	}
+	if data, _ = os.ReadFile(log); string(data) != item.cacheFile+"\n"+file+"\n" {
+		t.Errorf("Player calls: %q; expected the native audio and the recording", data)
+	}
+
+	cfg["RECORDER"] = "false"
+	s.record(item)
+	if !strings.HasPrefix(s.status, "recorder failed") {
+		t.Errorf("Wrong status after failed recording: %q", s.status)
+	}
+}
+
+func TestSparkline(t *testing.T) {
+	audio := &pcm{rate: 4, channels: 2, samples: []float32{
+		0, 0, 0.01, -0.01, 0.5, 0.2, -0.5, 0, 1, -1, 0.3, 0, 0, 0, 0.25, 0.1}}
+	if wave := audio.sparkline(4); wave != " ▄█▂" {
+		t.Errorf("sparkline() == %q; expected \" ▄█▂\"", wave)
+	}
+
+	cfg := make(Config)
+	cfg["VERBOSE"] = "no"
+	cfg["LANG"] = "en"
+	cfg["ATYPE"] = "mp3"
+	cfg["PRONUNCIATION_CHECK"] = "no"
+	cfg["CACHE_DIR"] = t.TempDir()
+	getHTML = getTestURL
+
+	s, _ := scriptedSession(cfg, nil, nil)
+	item := getPronList(cfg, "cat")[0]
+	if col := s.clipColumn(item); strings.TrimSpace(col) != "" {
+		t.Errorf("Audio is not downloaded, but clip column is %q", col)
+	}
+	if err := downloadTestFile(cfg, item.aURL, item.cacheFile); err != nil {
+		t.Fatal(err)
+	}
+	info, err := loadClipInfo(item.cacheFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf("%4.1fs %s", info.duration.Seconds(), info.wave)
+	if col := s.clipColumn(item); col != want || info.duration == 0 {
+		t.Errorf("clipColumn() == %q; expected %q", col, want)
+	}
+}
+
+func TestClipProblem(t *testing.T) {
+	tone := func(seconds, amplitude float64) *pcm {
+		audio := &pcm{rate: 8000, channels: 1}
+		for i := 0; i < int(seconds*8000); i++ {
+			v := amplitude * math.Sin(float64(i)*2*math.Pi*440/8000)
+			audio.samples = append(audio.samples, float32(math.Max(-1, math.Min(1, v))))
+		}
+		return audio
+	}
+	rnd := rand.New(rand.NewSource(1))
+	noisy := func(audio *pcm, amplitude float64) *pcm {
+		for i := range audio.samples {
+			audio.samples[i] += float32(amplitude * rnd.NormFloat64())
+		}
+		return audio
+	}
+	for _, tc := range []struct {
+		audio   *pcm
+		problem string
+	}{
+		{tone(1, 0.5), ""},
+		{tone(0.1, 0.5), "too short"},
+		{tone(1, 0), "silent"},
+		{tone(1, 0.001), "silent"},
+		{tone(1, 3), "clipped"},
+		{noisy(tone(1, 0), 0.1), "noisy"},
+		{noisy(tone(1, 0.5), 0.005), ""},
+		{tone(10, 0.5), "too long"},
+	} {
+		if problem := tc.audio.problem(); problem != tc.problem {
+			t.Errorf("problem() of %v audio == %q; expected %q", tc.audio.duration(),
+				problem, tc.problem)
+		}
+	}
+
+	dir := t.TempDir()
+	cfg := make(Config)
+	cfg["VERBOSE"] = "no"
+	cfg["LANG"] = "en"
+	cfg["ATYPE"] = "mp3"
+	cfg["PRONUNCIATION_CHECK"] = "no"
+	getHTML = getTestURL
+	list := getPronList(cfg, "cat")
+	list[0].cacheFile = filepath.Join(dir, "silent.wav")
+	list[1].cacheFile = filepath.Join(dir, "good.mp3")
+	list[2].cacheFile = filepath.Join(dir, "missing.mp3")
+	if err := writeWav(list[0].cacheFile, tone(1, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := downloadTestFile(cfg, list[1].aURL, list[1].cacheFile); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := demoteBroken(cfg, list); !reflect.DeepEqual(got, list) {
+		t.Errorf("Pronunciations should not be checked with QUALITY_CHECK=no")
+	}
+	cfg["QUALITY_CHECK"] = "yes"
+	want := []Pron{list[1], list[2], list[0]}
+	if got := demoteBroken(cfg, list); !reflect.DeepEqual(got, want) {
+		t.Errorf("Silent recording should go last: %v", got)
+	}
+
+	s, _ := scriptedSession(cfg, &argsSource{words: []string{"cat"}}, nil)
+	s.fetchWord()
+	s.lists["cat"] = list
+	lines := stripANSI(strings.Join(s.render(100, 12), "\n"))
+	if !strings.Contains(lines, "Author1  (male from United Kingdom)  ⚠ silent") ||
+		strings.Contains(lines, "Author2  (male from Unknown)  ⚠") {
+		t.Errorf("Silent recording is not marked:\n%s", lines)
+	}
+}
+
+func TestWavRoundTrip(t *testing.T) {
+	audio := &pcm{rate: 8000, channels: 1, samples: []float32{0, 0.5, -0.5, 1, -1}}
+	file := filepath.Join(t.TempDir(), "test.wav")
+	if err := writeWav(file, audio); err != nil {
+		t.Fatal(err)
+	}
+	got, err := decodeAudio(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.rate != audio.rate || got.channels != audio.channels ||
+		len(got.samples) != len(audio.samples) {
+		t.Fatalf("Decoded wav: rate %d, channels %d, %d samples; expected %d, %d, %d",
+			got.rate, got.channels, len(got.samples),
+			audio.rate, audio.channels, len(audio.samples))
+	}
+	for i := range audio.samples {
+		if d := got.samples[i] - audio.samples[i]; d > 0.001 || d < -0.001 {
+			t.Errorf("samples[%d] == %f; expected %f", i, got.samples[i], audio.samples[i])
+		}
+	}
+}
+
+func TestSaveWordConvert(t *testing.T) {
+	cfg := make(Config)
+	cfg["VERBOSE"] = "no"
+	cfg["CACHE"] = "yes"
+	cfg["CACHE_DIR"] = t.TempDir()
+	cfg["DOWNLOAD"] = "yes"
+	cfg["LANG"] = "en"
+	cfg["ATYPE"] = "mp3"
+	cfg["OUTPUT_FORMAT"] = "wav"
+	cfg["PRONUNCIATION_CHECK"] = "no"
+	getHTML = getTestURL
+	getAudio = downloadTestFile
+
+	list := getPronList(cfg, "cat")
+	if list[0].aFile != "cat.wav" {
+		t.Errorf("list[0].aFile == %s; expected cat.wav", list[0].aFile)
+	}
+	list[0].aFile = filepath.Join(t.TempDir(), list[0].aFile)
+	if got, err := saveWord(cfg, list[0]); err != nil || got != list[0].aFile {
+		t.Fatalf("saveWord() == %s, %v; expected %s", got, err, list[0].aFile)
+	}
+	if got, _ := playableFile(cfg, list[0]); got != list[0].cacheFile {
+		t.Errorf("playableFile() == %s; expected %s", got, list[0].cacheFile)
+	}
+
+	// an export error is returned with the cached file, which can be played
+	item := list[0]
+	item.aFile = filepath.Join(t.TempDir(), "no_such_dir", "cat.mp3")
+	cfg["OUTPUT_FORMAT"] = "mp3"
+	if got, err := saveWord(cfg, item); err == nil || got != item.cacheFile {
+		t.Errorf("saveWord() to missing directory == %s, %v; expected %s and error",
+			got, err, item.cacheFile)
+	}
+	cfg["OUTPUT_FORMAT"] = "wav"
+
+	audio, err := decodeAudio(list[0].aFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, _ := decodeAudio(list[0].cacheFile)
+	ratio := float64(audio.frames()) / float64(src.frames())
+	if ratio < 0.95 || ratio > 1.05 {
+		t.Errorf("Converted file has %d frames; expected %d", audio.frames(), src.frames())
+	}
+
+	// without cache the file is downloaded to a private temporary directory
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	cfg["CACHE"] = "no"
+	os.Remove(list[0].aFile)
+	if got, err := saveWord(cfg, list[0]); err != nil || got != list[0].aFile {
+		t.Fatalf("saveWord() without cache == %s, %v; expected %s", got, err, list[0].aFile)
+	}
+	if files, _ := os.ReadDir(tmp); len(files) != 0 {
+		t.Errorf("Temporary files are left: %v", files)
+	}
+}
+
+// sineWave generates mono sine wave with silence before and after it
+func sineWave(rate int, freq, amp, silence, length float64) *pcm {
+	audio := &pcm{rate: rate, channels: 1}
+	pad := int(silence * float64(rate))
+	audio.samples = make([]float32, pad)
+	for i := 0; i < int(length*float64(rate)); i++ {
+		v := amp * math.Sin(2*math.Pi*freq*float64(i)/float64(rate))
+		audio.samples = append(audio.samples, float32(v))
+	}
+	audio.samples = append(audio.samples, make([]float32, pad)...)
+	return audio
+}
+
+func TestLoudness(t *testing.T) {
+	// BS.1770: 0 dBFS 997 Hz sine in one channel gives -3.01 LUFS
+	for _, rate := range []int{44100, 48000} {
+		got := sineWave(rate, 997, 1, 0, 2).loudness()
+		if math.Abs(got+3.01) > 0.1 {
+			t.Errorf("loudness() at %d Hz == %.2f; expected -3.01", rate, got)
+		}
+	}
+
+	audio := sineWave(44100, 997, 0.1, 0.5, 1).normalize(-16)
+	if got := audio.loudness(); math.Abs(got+16) > 0.1 {
+		t.Errorf("Loudness after normalize(-16) == %.2f", got)
+	}
+
+	audio = sineWave(44100, 997, 0.5, 0, 1).normalize(-1)
+	for i, v := range audio.samples {
+		if math.Abs(float64(v)) > peakLimit+0.001 {
+			t.Fatalf("samples[%d] == %f; normalized audio should not clip", i, v)
+		}
+	}
+}
+
+func TestTrimSilence(t *testing.T) {
+	audio := sineWave(8000, 440, 0.5, 1, 0.5)
+	got := audio.trimSilence(silenceThreshold)
+	want := 0.5 + 2*silencePad
+	if d := got.duration().Seconds() - want; d > 0.02 || d < -0.02 {
+		t.Errorf("Duration after trimSilence() == %v; expected about %.2fs",
+			got.duration(), want)
+	}
+
+	silent := &pcm{rate: 8000, channels: 1, samples: make([]float32, 8000)}
+	if got := silent.trimSilence(silenceThreshold); got.frames() != 8000 {
+		t.Errorf("Silent audio should not be trimmed")
+	}
+}
+
+func TestProcessAudio(t *testing.T) {
+	cfg := make(Config)
+	cfg["VERBOSE"] = "no"
+	cfg["CACHE"] = "yes"
+	cfg["CACHE_DIR"] = t.TempDir()
+	cfg["TRIM_SILENCE"] = "yes"
+	cfg["NORMALIZE"] = "yes"
+	cfg["TARGET_LUFS"] = "-20"
+
+	src := filepath.Join(t.TempDir(), "cat.mp3")
+	if err := copyFile(cfg, "local_files/forvo_en_cat.mp3", src); err != nil {
+		t.Fatal(err)
+	}
+	processed, err := processAudio(cfg, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(processed, cfg["CACHE_DIR"]) {
+		t.Errorf("Processed file %s should be in cache", processed)
+	}
+	audio, err := decodeAudio(processed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := audio.loudness(); math.Abs(got+20) > 0.5 {
+		t.Errorf("Loudness of processed file == %.2f; expected -20", got)
+	}
+
+	orig, _ := decodeAudio(src)
+	if audio.frames() > orig.frames() {
+		t.Errorf("Processed file is longer than original")
+	}
+
+	cfg["CACHE"] = "no"
+	if processed, err = processAudio(cfg, src); err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(processed) != filepath.Dir(src) {
+		t.Errorf("Processed file %s should be next to temporary %s", processed, src)
+	}
+}
+
+func TestTagAudio(t *testing.T) {
+	cfg := make(Config)
+	cfg["VERBOSE"] = "no"
+	cfg["CACHE"] = "yes"
+	cfg["CACHE_DIR"] = t.TempDir()
+	cfg["DOWNLOAD"] = "yes"
+	cfg["LANG"] = "en"
+	cfg["ATYPE"] = "mp3"
+	cfg["TAGS"] = "yes"
+	cfg["PRONUNCIATION_CHECK"] = "no"
+	getHTML = getTestURL
+	getAudio = downloadTestFile
+
+	list := getPronList(cfg, "cat")
+	list[0].aFile = filepath.Join(t.TempDir(), list[0].aFile)
+	for i := 0; i < 2; i++ {
+		// the second save must replace the tag, not add one more
+		if _, err := saveWord(cfg, list[0]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := os.ReadFile(list[0].aFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data[0:3]) != "ID3" || bytes.Count(data, []byte("TIT2")) != 1 {
+		t.Errorf("Saved mp3 file should have one ID3 tag")
+	}
+	if !bytes.Contains(data, id3UTF16(list[0].author)[2:]) {
+		t.Errorf("ID3 tag does not contain author %s", list[0].author)
+	}
+	if _, err = decodeAudio(list[0].aFile); err != nil {
+		t.Errorf("Tagged mp3 can not be decoded: %v", err)
+	}
+	cached, _ := os.ReadFile(list[0].cacheFile)
+	if bytes.HasPrefix(cached, []byte("ID3\x03")) {
+		t.Errorf("Cached file should not be tagged")
+	}
+
+	tags := pronTags(cfg, list[0])
+	if !strings.HasSuffix(tags.comment, ", https://forvo.com/word/cat/#en") {
+		t.Errorf("Wrong comment tag: %s", tags.comment)
+	}
+
+	wav := filepath.Join(t.TempDir(), "cat.wav")
+	writeWav(wav, sineWave(8000, 440, 0.5, 0, 0.5))
+	if err = tagAudio(cfg, list[0], wav); err != nil {
+		t.Fatal(err)
+	}
+	data, _ = os.ReadFile(wav)
+	if !bytes.Contains(data, []byte("INAM\x04\x00\x00\x00cat\x00")) {
+		t.Errorf("Wav file should have INFO chunk with the word")
+	}
+	if audio, err := decodeAudio(wav); err != nil || audio.frames() != 4000 {
+		t.Errorf("Tagged wav can not be decoded: %v", err)
+	}
+
+	flac := []byte("fLaC\x80\x00\x00\x22")
+	flac = append(flac, make([]byte, 0x22)...)
+	flac = append(flac, "frames"...)
+	flac, err = writeFlacComments(flac, tags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flac[4] != 0 || flac[42] != 0x84 || !bytes.HasSuffix(flac, []byte("frames")) ||
+		!bytes.Contains(flac, []byte("TITLE=cat")) {
+		t.Errorf("Wrong flac metadata: %q", flac)
+	}
+}
+
+func TestOggComments(t *testing.T) {
+	comment := append([]byte("\x03vorbis"),
+		encodeVorbisComment("test", []string{"TITLE=dog", "DATE=2020"}, audioTags{})...)
+	comment = append(comment, 1)
+	setup := append([]byte("\x05vorbis"), make([]byte, 600)...)
+	var data []byte
+	pages := oggPacketPages(7, 0, [][]byte{[]byte("\x01vorbis id")})
+	pages = append(pages, oggPacketPages(7, 1, [][]byte{comment, setup})...)
+	pages = append(pages, oggPacketPages(7, 2, [][]byte{[]byte("audio")})...)
+	pages[0].headerType = 2
+	for _, page := range pages {
+		data = append(data, page.encode()...)
+	}
+
+	tags := audioTags{title: "cat", artist: strings.Repeat("a", 70000)}
+	data, err := writeOggComments(data, tags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pages, err = readOggPages(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pages) != 4 {
+		t.Fatalf("len(pages) == %d; expected 4", len(pages))
+	}
+	for i, page := range pages {
+		if page.seq != uint32(i) {
+			t.Errorf("pages[%d].seq == %d", i, page.seq)
+		}
+		if !bytes.Equal(page.encode(), data[:len(page.encode())]) {
+			t.Errorf("pages[%d] has wrong checksum", i)
+		}
+		data = data[len(page.encode()):]
+	}
+	// the long comment does not fit into one page
+	if pages[2].headerType != 1 || string(pages[3].body) != "audio" {
+		t.Errorf("Wrong continued page or audio page")
+	}
+
+	// DATE is kept and TITLE is replaced
+	packet := append(pages[1].body, pages[2].body...)
+	_, comments, err := parseVorbisComment(packet[7:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"DATE=2020", "TITLE=cat", "ARTIST=" + tags.artist, "ALBUM=", "COMMENT="}
+	if !reflect.DeepEqual(comments, want) {
+		t.Errorf("comments == %q; expected %q", comments, want)
+	}
+}
+
+func TestPlaylist(t *testing.T) {
+	cfg := make(Config)
+	cfg["VERBOSE"] = "no"
+	cfg["CACHE"] = "yes"
+	cfg["CACHE_DIR"] = t.TempDir()
+	cfg["LANG"] = "en"
+	cfg["ATYPE"] = "mp3"
+	cfg["PRONUNCIATION_CHECK"] = "no"
+	cfg["PLAYLIST_GAP"] = "500"
+	getHTML = getTestURL
+	getAudio = downloadTestFile
+
+	dir := t.TempDir()
+	playlist(cfg, []string{filepath.Join(dir, "words.m3u"), "cat", "dog"})
+	data, err := os.ReadFile(filepath.Join(dir, "words.m3u"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 5 || lines[0] != "#EXTM3U" || lines[2] != "cat.mp3" ||
+		lines[4] != "dog.mp3" || !strings.HasPrefix(lines[1], "#EXTINF:1,cat - ") {
+		t.Errorf("Wrong m3u playlist:\n%s", data)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "dog.mp3")); err != nil {
+		t.Errorf("Files should be saved next to playlist: %v", err)
+	}
+
+	playlist(cfg, []string{filepath.Join(dir, "words.pls"), "cat"})
+	data, _ = os.ReadFile(filepath.Join(dir, "words.pls"))
+	if !strings.Contains(string(data), "File1=cat.mp3\n") ||
+		!strings.HasSuffix(string(data), "NumberOfEntries=1\nVersion=2\n") {
+		t.Errorf("Wrong pls playlist:\n%s", data)
+	}
+
+	// TTS stub copies prepared speech instead of synthesizing it
+	speech := filepath.Join(dir, "speech.wav")
+	writeWav(speech, sineWave(16000, 440, 0.5, 0, 0.25))
+	cfg["TTS"] = "cp " + speech + " {file}"
+	track := filepath.Join(dir, "track.wav")
+	playlist(cfg, []string{track, "cat", "dog"})
+	audio, err := decodeAudio(track)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cat, _ := decodeAudio("local_files/forvo_en_cat.mp3")
+	dog, _ := decodeAudio("local_files/forvo_en_dog.mp3")
+	want := cat.duration() + dog.duration() + 2*250*time.Millisecond +
+		500*time.Millisecond + 2*250*time.Millisecond
+	if d := audio.duration() - want; d > 10*time.Millisecond || d < -10*time.Millisecond {
+		t.Errorf("Track duration == %v; expected %v", audio.duration(), want)
+	}
+}
+
+func TestExportAnki(t *testing.T) {
+	cfg := make(Config)
+	cfg["VERBOSE"] = "no"
+	cfg["CACHE"] = "yes"
+	cfg["CACHE_DIR"] = t.TempDir()
+	cfg["LANG"] = "en"
+	cfg["ATYPE"] = "mp3"
+	cfg["PRONUNCIATION_CHECK"] = "no"
+	cfg["ANKI_COUNTRY"] = "usa"
+	getHTML = getTestURL
+	getAudio = downloadTestFile
+
+	deck := filepath.Join(t.TempDir(), "animals.csv")
+	exportAnki(cfg, []string{deck, "cat", "dog"})
+	data, err := os.ReadFile(deck)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(string(data), "\n")
+	if len(lines) < 6 || lines[2] != "#columns:Word,Audio,Author,Country,Sex" ||
+		lines[4] != "cat,[sound:tellme_en_cat.mp3],Author3,USA,male" {
+		t.Errorf("Wrong deck file:\n%s", data)
+	}
+	media := strings.TrimSuffix(deck, ".csv") + ".media"
+	for _, name := range []string{"tellme_en_cat.mp3", "tellme_en_dog.mp3"} {
+		if _, err = os.Stat(filepath.Join(media, name)); err != nil {
+			t.Errorf("Media file is missing: %v", err)
+		}
+	}
+}
+
+// stripANSI removes terminal escape sequences from a string
+func stripANSI(s string) string {
+	return regexp.MustCompile(`\x1b\[[0-9;?]*[a-zA-Z]`).ReplaceAllString(s, "")
+}
+
+func TestTUIRender(t *testing.T) {
+	cfg := make(Config)
+	cfg["VERBOSE"] = "no"
+	cfg["LANG"] = "en"
+	cfg["ATYPE"] = "mp3"
+	cfg["SPEED"] = "1.0"
+	cfg["PRONUNCIATION_CHECK"] = "no"
+	getHTML = getTestURL
+
+	ui, err := newSession(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ui.source = &argsSource{words: []string{"cat", "dog", "tafel"}}
+	ui.out = io.Discard
+	for ui.fetchWord() {
+	}
+	ui.list()
+	ui.handle("down")
+	lines := ui.render(60, 10)
+	if len(lines) != 10 {
+		t.Fatalf("len(render()) == %d; expected 10", len(lines))
+	}
+	for i, line := range lines {
+		if n := utf8.RuneCountInString(stripANSI(line)); n != 60 {
+			t.Errorf("Line %d has width %d; expected 60: %q", i, n, line)
+		}
+	}
+	if !strings.Contains(lines[1], ansiReverse+" cat") {
+		t.Errorf("Current word should be highlighted: %q", lines[1])
+	}
+	if !regexp.MustCompile(`\x1b\[7m ▶ 1 +Author2`).MatchString(lines[5]) {
+		t.Errorf("Current pronunciation should be highlighted: %q", lines[5])
+	}
+	if !strings.Contains(lines[8], " word 1/3  pronunciation 2/3  speed 1.0x") {
+		t.Errorf("Wrong status bar: %q", lines[8])
+	}
+
+	ui.handle("2")
+	if ui.pronIdx != 2 {
+		t.Errorf("pronIdx == %d after pressing 2; expected 2", ui.pronIdx)
+	}
+	ui.handle("right")
+	ui.handle("n")
+	ui.list()
+	if ui.wordIdx != 2 || !strings.Contains(ui.render(60, 10)[4], "No pronunciations") {
+		t.Errorf("Word without pronunciations is not shown")
+	}
+	if _, quit := ui.handle("q"); !quit {
+		t.Errorf("q should quit")
+	}
+}
+
+func TestSuggestWords(t *testing.T) {
+	for _, c := range []struct {
+		a, b string
+		d    int
+	}{{"recieve", "receive", 1}, {"kitten", "sitting", 3}, {"", "abc", 3},
+		{"Straße", "strasse", 2}, {"Cat", "cat", 0}} {
+		if d := editDistance(c.a, c.b); d != c.d {
+			t.Errorf("editDistance(%q, %q) == %d; expected %d", c.a, c.b, d, c.d)
+		}
+	}
+
+	cfg := make(Config)
+	cfg["VERBOSE"] = "no"
+	cfg["LANG"] = "en"
+	cfg["CACHE_DIR"] = t.TempDir()
+	getHTML = getTestURL
+	for _, word := range []string{"recipe", "receive", "cat", "deceive"} {
+		path := indexPath(cfg, "en", word)
+		os.MkdirAll(filepath.Dir(path), 0750)
+		os.WriteFile(path, []byte("{}"), 0640)
+	}
+	got := suggestWords(cfg, "recieve", "", nil)
+	want := []string{"receive", "deceive", "recipe"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("suggestWords(recieve) == %q; expected %q", got, want)
+	}
+	got = suggestWords(cfg, "dgo", "", []string{"dgo", "dg", "god"})
+	want = []string{"dog", "hot dog", "dg"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("suggestWords(dgo) == %q; expected %q", got, want)
+	}
+}
+
+func TestLibrary(t *testing.T) {
+	cfg := make(Config)
+	cfg["VERBOSE"] = "no"
+	cfg["LANG"] = "en"
+	cfg["ATYPE"] = "mp3"
+	cfg["PRONUNCIATION_CHECK"] = "no"
+	cfg["LIBRARY"] = filepath.Join(t.TempDir(), "tellme", "library.json")
+	getHTML = getTestURL
+	defer func() { userLibrary = nil }()
+
+	lib, err := openLibrary(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cat := getPronList(cfg, "cat")
+	dog := getPronList(cfg, "dog")
+	if !lib.toggleStar("en", cat[1]) || !lib.toggleStar("en", cat[0]) {
+		t.Errorf("toggleStar() should star pronunciations")
+	}
+	lib.toggleStar("en", cat[0])
+	lib.tag("en", cat[2], []string{"lesson-4", "Animals"})
+	lib.tag("en", dog[0], []string{"lesson-4", "lesson-4"})
+	if err := lib.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	lib, err = loadLibrary(cfg["LIBRARY"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lib.Entries) != 4 || lib.entry("en", cat[0]).Starred ||
+		len(lib.entry("en", dog[0]).Tags) != 1 {
+		t.Errorf("Wrong library entries: %+v", lib.Entries)
+	}
+	for tag, want := range map[string][]string{"lesson-4": {"cat", "dog"},
+		"animals": {"cat"}, starredTag: {"cat"}, "lesson-5": nil} {
+		if words := lib.taggedWords("en", tag); !reflect.DeepEqual(words, want) {
+			t.Errorf("taggedWords(%s) == %q; expected %q", tag, words, want)
+		}
+	}
+
+	cfg["TAG"] = "lesson-4"
+	if words := readWords(cfg, []string{"dog", "test", "cat"}); !reflect.DeepEqual(words,
+		[]string{"dog", "cat"}) {
+		t.Errorf("readWords() == %q; expected only tagged words", words)
+	}
+	if words, _ := filterTagged(cfg, nil); !reflect.DeepEqual(words, []string{"cat", "dog"}) {
+		t.Errorf("filterTagged() == %q; expected all tagged words", words)
+	}
+	if list := getPronList(cfg, "cat"); list[0].author != "Author3" || len(list) != 3 {
+		t.Errorf("Tagged pronunciation should go first")
+	}
+	cfg["TAG"] = starredTag
+	if list := getPronList(cfg, "cat"); list[0].author != "Author2" {
+		t.Errorf("Starred pronunciation should go first")
+	}
+
+	cfg["LIBRARY"] = filepath.Join(t.TempDir(), "broken.json")
+	os.WriteFile(cfg["LIBRARY"], []byte("{"), 0640)
+	if _, err = newSession(cfg); err == nil {
+		t.Errorf("Session should not start with a broken library")
+	}
+	if list := getPronList(cfg, "cat"); len(list) != 3 {
+		t.Errorf("Broken library should not lose pronunciations")
+	}
+}
+
+func TestHistory(t *testing.T) {
+	cfg := make(Config)
+	cfg["VERBOSE"] = "no"
+	cfg["LANG"] = "en"
+	cfg["ATYPE"] = "mp3"
+	cfg["PRONUNCIATION_CHECK"] = "no"
+	cfg["HISTORY"] = filepath.Join(t.TempDir(), "tellme", "history.jsonl")
+	getHTML = getTestURL
+
+	lookupWord(cfg, "cat")
+	lookupWord(cfg, "tafel")
+	lookupWord(cfg, "cat")
+	cfg["LANG"] = "de"
+	addHistory(cfg, "Katze", Pron{})
+
+	entries, err := readHistory(cfg["HISTORY"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 4 || entries[0].Author != "Author1" || entries[1].Author != "" {
+		t.Fatalf("Wrong history entries: %+v", entries)
+	}
+	if words := recentWords(entries, "en"); !reflect.DeepEqual(words, []string{"cat", "tafel"}) {
+		t.Errorf("recentWords() == %q; expected [cat tafel]", words)
+	}
+	if found := searchHistory(entries, "AT"); len(found) != 3 {
+		t.Errorf("searchHistory() found %d entries; expected 3", len(found))
+	}
+
+	dir := t.TempDir()
+	for file, want := range map[string]string{
+		"words.txt": "cat\ntafel\nKatze\n",
+		"words.csv": "time,lang,word,author,country,id\n",
+	} {
+		path := filepath.Join(dir, file)
+		if err = exportHistory(path, entries); err != nil {
+			t.Fatal(err)
+		}
+		data, _ := os.ReadFile(path)
+		if !strings.HasPrefix(string(data), want) {
+			t.Errorf("Wrong %s:\n%s", file, data)
+		}
+	}
+	path := filepath.Join(dir, "words.json")
+	if err = exportHistory(path, searchHistory(entries, "katze")); err != nil {
+		t.Fatal(err)
+	}
+	var exported []historyEntry
+	data, _ := os.ReadFile(path)
+	if err = json.Unmarshal(data, &exported); err != nil || len(exported) != 1 ||
+		exported[0].Lang != "de" {
+		t.Errorf("Wrong words.json: %s", data)
+	}
+
+	os.WriteFile(cfg["HISTORY"], []byte("{\"word\": \"cat\"}\nbroken\n"), 0640)
+	if _, err = readHistory(cfg["HISTORY"]); err == nil {
+		t.Errorf("Broken history file should give an error")
+	}
+}
+
+func TestLineEditor(t *testing.T) {
+	history := []string{"dog", "cat"}
+	complete := func(prefix string) []string {
+		return completeWord([]string{"Catalog", "cat", "category", "dog"}, prefix)
+	}
+	for _, c := range []struct {
+		keys   []string
+		line   string
+		cursor int
+	}{
+		{[]string{"c", "a", "t", "left", "left", "x"}, "cxat", 2},
+		{[]string{"a", "b", "\x01", "x", "\x05", "y", "home", "\x04"}, "aby", 0},
+		{[]string{"S", "t", "r", "a", "ß", "e", "left", "\x7f", "\x7f"}, "Stre", 3},
+		{[]string{"e", "\u0301", "x", "left", "left", "right"}, "e\u0301x", 1},
+		{[]string{"e", "\u0301", "x", "left", "\x7f"}, "x", 0},
+		{[]string{"h", "o", "t", " ", "d", "o", "g", "\x17", "\x17"}, "", 0},
+		{[]string{"a", "b", " ", "c", "d", "ctrl-left", "\x0b"}, "ab ", 3},
+		{[]string{"a", "b", "c", "left", "\x15"}, "c", 0},
+		{[]string{"x", "up", "up", "up", "down"}, "dog", 3},
+		{[]string{"x", "up", "down", "y"}, "xy", 2},
+		{[]string{"C", "\t"}, "Cat", 3},
+		{[]string{"C", "\t", "\t", "\t", "\t"}, "category", 8},
+		{[]string{"d", "!", "left", "\t"}, "dog!", 3},
+		{[]string{"z", "\t", "\x1bOD"}, "z", 1},
+	} {
+		ed := newLineEditor(history, complete)
+		for _, key := range c.keys {
+			if done, cancel := ed.handle(key); done || cancel {
+				t.Errorf("%q: key %q should not finish input", c.keys, key)
+			}
+		}
+		if ed.String() != c.line || ed.cursor() != c.cursor {
+			t.Errorf("%q gives %q with cursor %d; expected %q with cursor %d",
+				c.keys, ed.String(), ed.cursor(), c.line, c.cursor)
+		}
+	}
+
+	ed := newLineEditor(nil, nil)
+	if done, _ := ed.handle("\n"); done {
+		t.Errorf("Empty line should not be finished")
+	}
+	ed.handle("a")
+	if done, _ := ed.handle("\n"); !done {
+		t.Errorf("Enter should finish the line")
+	}
+	if _, cancel := ed.handle("\x03"); !cancel {
+		t.Errorf("Ctrl-C should cancel the input")
+	}
+
+	bar := editorBar(" │ Word: ", &lineEditor{buf: []rune("catalog"), pos: 3}, 40)
+	if !strings.Contains(bar, "cat"+ansiReset+"a"+ansiReverse+"log") {
+		t.Errorf("Cursor is not shown: %q", bar)
+	}
+	bar = editorBar(" │ Word: ", &lineEditor{buf: []rune(strings.Repeat("a", 50)), pos: 50}, 40)
+	if n := utf8.RuneCountInString(stripANSI(bar)); n != 40 || !strings.HasSuffix(bar,
+		ansiReset+" "+ansiReverse+ansiReset) {
+		t.Errorf("Long line should be scrolled to the cursor: %q", bar)
+	}
+}
+
+func TestDrillCard(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	c := newCard("cat", "en")
+	for _, step := range []struct {
+		grade, interval, reps int
+		ease                  float64
+	}{
+		{gradeGood, 1, 1, 2.5},
+		{gradeGood, 6, 2, 2.5},
+		{gradeGood, 15, 3, 2.5},
+		{gradeEasy, 38, 4, 2.6},
+		{gradeAgain, 1, 0, 2.28},
+		{gradeHard, 1, 1, 2.14},
+	} {
+		c.grade(step.grade, now)
+		if c.Interval != step.interval || c.Reps != step.reps ||
+			math.Abs(c.Ease-step.ease) > 1e-9 {
+			t.Errorf("After %s: interval %d, reps %d, ease %.2f; expected %d, %d, %.2f",
+				gradeNames[step.grade], c.Interval, c.Reps, c.Ease, step.interval,
+				step.reps, step.ease)
+		}
+		if !c.Due.Equal(now.AddDate(0, 0, step.interval)) {
+			t.Errorf("Due == %v; expected in %d days", c.Due, step.interval)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		c.grade(gradeAgain, now)
+	}
+	if c.Ease != minEase || c.Lapses != 11 {
+		t.Errorf("Ease == %.2f, lapses == %d; expected %.2f and 11", c.Ease, c.Lapses, minEase)
+	}
+}
+
+func TestDrill(t *testing.T) {
+	cfg := make(Config)
+	cfg["VERBOSE"] = "no"
+	cfg["LANG"] = "en"
+	cfg["ATYPE"] = "mp3"
+	cfg["SPEED"] = "1.0"
+	cfg["PRONUNCIATION_CHECK"] = "no"
+	cfg["DRILL_NEW"] = "5"
+	dir := t.TempDir()
+	cfg["DRILL"] = filepath.Join(dir, "drill.json")
+	cfg["HISTORY"] = filepath.Join(dir, "history.jsonl")
+	getHTML = getTestURL
+
+	now := time.Now()
+	store := &drillStore{path: cfg["DRILL"], Cards: []*drillCard{
+		{Word: "test", Lang: "en", Ease: 2.5, Interval: 6, Reps: 2, Due: now.AddDate(0, 0, 3)},
+		{Word: "dog", Lang: "en", Ease: 2.5, Interval: 6, Reps: 2, Due: now.AddDate(0, 0, -1)},
+	}}
+	if err := store.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := newDrill(cfg, []string{"cat", "dog", "test", "cat"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.queue) != 2 || d.queue[0].Word != "dog" || d.queue[1].Word != "cat" {
+		t.Fatalf("Queue should have due dog and new cat")
+	}
+	keys := []string{"x", "1", " ", "4", "r", "\n", "1", " ", "3"}
+	s, played := scriptedSession(cfg, nil, keys)
+	d.readKey, d.play, d.out = s.readKey, s.play, s.out
+	d.width, d.height = 80, 24
+	d.nextCard()
+	if lines := strings.Join(d.render(60, 12), "\n"); !strings.Contains(lines, "???") ||
+		strings.Contains(lines, "dog") {
+		t.Errorf("Word should be hidden:\n%s", stripANSI(lines))
+	}
+	d.queue = append([]*drillCard{d.card}, d.queue...)
+	d.run()
+
+	want := []string{"dog:Author3", "cat:Author1", "cat:Author1", "cat:Author2"}
+	if !reflect.DeepEqual(*played, want) {
+		t.Errorf("Played %q; expected %q", *played, want)
+	}
+	if sum := d.summary(); !strings.HasPrefix(sum, "Reviewed: again 1, hard 0, good 1, easy 1.") {
+		t.Errorf("Wrong summary: %s", sum)
+	}
+
+	store, err = loadDrillStore(cfg["DRILL"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	dog, cat := store.card("dog", "en"), store.card("cat", "en")
+	if len(store.Cards) != 3 || dog.Interval != 15 || cat == nil || cat.Lapses != 1 ||
+		cat.Reps != 1 {
+		t.Errorf("Wrong cards after drill: dog %+v, cat %+v", dog, cat)
+	}
+
+	addHistory(cfg, "bird", Pron{})
+	addHistory(cfg, "dog", Pron{})
+	d, err = newDrill(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.queue) != 1 || d.queue[0].Word != "bird" || !d.isNew[d.queue[0]] {
+		t.Errorf("New words should come from history")
+	}
+}
+
+func TestCheckAnswer(t *testing.T) {
+	for _, tc := range []struct {
+		answer, word string
+		result       int
+	}{
+		{"cat", "cat", answerCorrect},
+		{" Hot   DOG ", "hot dog", answerCorrect},
+		{"cafe\u0301", "café", answerCorrect},
+		{"CAFÉ", "cafe\u0301", answerCorrect},
+		{"cafe", "café", answerAccents},
+		{"über", "uber", answerAccents},
+		{"recieve", "receive", answerTypo},
+		{"cats", "cat", answerTypo},
+		{"dog", "cat", answerWrong},
+		{"", "a", answerWrong},
+	} {
+		if result := checkAnswer(tc.answer, tc.word); result != tc.result {
+			t.Errorf("checkAnswer(%q, %q) == %d; expected %d", tc.answer, tc.word,
+				result, tc.result)
+		}
+	}
+}
+
+func TestQuiz(t *testing.T) {
+	cfg := make(Config)
+	cfg["VERBOSE"] = "no"
+	cfg["LANG"] = "en"
+	cfg["ATYPE"] = "mp3"
+	cfg["SPEED"] = "1.0"
+	cfg["PRONUNCIATION_CHECK"] = "no"
+	cfg["QUIZ_ROUNDS"] = "3"
+	getHTML = getTestURL
+
+	q, err := newQuiz(cfg, []string{"cat", "tafel", "dog", "test"}, rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.rounds != 3 || len(q.order) != 4 {
+		t.Fatalf("Quiz should have 3 rounds of 4 words, got %d of %v", q.rounds, q.order)
+	}
+	// tafel has no pronunciations and is skipped
+	var words []string
+	for _, word := range q.order {
+		if word != "tafel" {
+			words = append(words, word)
+		}
+	}
+
+	keys := strings.Split(strings.ToUpper(words[0]), "")
+	keys = append(keys, "\t", "\n", "x", "z", "z", "\n", "x", "\x1b", "x")
+	s, played := scriptedSession(cfg, nil, keys)
+	q.readKey, q.play, q.out = s.readKey, s.play, s.out
+	q.width, q.height = 80, 24
+	q.run()
+
+	if len(*played) != 4 || !strings.HasPrefix((*played)[0], words[0]+":") ||
+		(*played)[0] != (*played)[1] || !strings.HasPrefix((*played)[3], words[2]+":") {
+		t.Errorf("Wrong pronunciations played: %q for words %q", *played, words)
+	}
+	want := fmt.Sprintf("Correct 1 of 3 (33%%).\nMistakes:\n  zz → %s\n  - → %s\n",
+		words[1], words[2])
+	if sum := q.summary(); sum != want {
+		t.Errorf("Summary == %q; expected %q", sum, want)
+	}
+	if lines := stripANSI(strings.Join(q.render(60, 12), "\n")); !strings.Contains(lines,
+		"The word is: "+words[2]) || !strings.Contains(lines, "correct 1 of 3") {
+		t.Errorf("Wrong result screen:\n%s", lines)
+	}
+
+	// quitting in the middle of a question does not count it
+	q, _ = newQuiz(cfg, words, rand.New(rand.NewSource(1)))
+	keys = strings.Split(q.order[0], "")
+	keys = append(keys, "\n", "x", "\x03")
+	s, _ = scriptedSession(cfg, nil, keys)
+	q.readKey, q.play, q.out = s.readKey, s.play, s.out
+	q.width, q.height = 80, 24
+	q.run()
+	if sum := q.summary(); sum != "Correct 1 of 1 (100%).\n" {
+		t.Errorf("Summary after quitting == %q; expected one answered word", sum)
+	}
+}
+
+func TestGetChar(t *testing.T) {
+	defer func(r *bufio.Reader) { stdinReader = r }(stdinReader)
+	stdinReader = bufio.NewReader(strings.NewReader(
+		"\x1b[Aj\r\x1bOD\x1b[Zé\x1b[1;5C\x1b[15~\x1bx\x1b[99X"))
+	var keys []string
+	for i := 0; i < 10; i++ {
+		key, err := getChar()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	want := []string{"up", "j", "\n", "left", "shift-tab", "é", "ctrl-right",
+		"f5", "alt-x", ""}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("getChar() returned %q; expected %q", keys, want)
+	}
+	if _, err := getChar(); err != io.EOF {
+		t.Errorf("getChar() at the end of input returned %v; expected EOF", err)
+	}
+}
+
+func TestKeymap(t *testing.T) {
+	km, err := newKeymap(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, action := range map[string]string{"j": "next_pron", "\n": "next_word",
+		"right": "next_word", "\x03": "quit", "x": "", "1": ""} {
+		if got := km.action(key); got != action {
+			t.Errorf("action(%q) == %q; expected %q", key, got, action)
+		}
+	}
+	if !strings.HasPrefix(km.helpLine(), "j/k:pronunciation  n/p:word") {
+		t.Errorf("Wrong help line: %q", km.helpLine())
+	}
+
+	km, err = newKeymap(Config{"KEYMAP": "emacs", "KEY_REPLAY": "space shift-ctrl-up",
+		"KEY_QUIT": "ctrl-q", "KEY_RETRY": "ctrl-i"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, action := range map[string]string{"\x0e": "next_pron", " ": "replay",
+		"ctrl-shift-up": "replay", "\x11": "quit", "\x12": "", "\x03": "",
+		"\t": "retry"} {
+		if got := km.action(key); got != action {
+			t.Errorf("action(%q) == %q; expected %q", key, got, action)
+		}
+	}
+	if !strings.Contains(km.helpLine(), "space:replay") {
+		t.Errorf("Wrong help line: %q", km.helpLine())
+	}
+
+	for _, cfg := range []Config{{"KEYMAP": "nano"}, {"KEY_REPLAY": "j"},
+		{"KEY_QUIT": "ctrl-1"}, {"KEY_QUIT": "hyper-up"}} {
+		if _, err = newKeymap(cfg); err == nil {
+			t.Errorf("newKeymap(%v) should fail", cfg)
+		}
+	}
+}
+
+// scriptedSession returns a session with keys taken from a script. Played
+// pronunciations are recorded as word:author.
+func scriptedSession(cfg Config, source WordSource, keys []string) (*session, *[]string) {
+	s, err := newSession(cfg)
+	if err != nil {
+		panic(err)
+	}
+	s.source = source
+	s.out = io.Discard
+	s.width, s.height = 80, 24
+	s.readKey = func() (string, error) {
+		if len(keys) == 0 {
+			return "q", nil
+		}
+		key := keys[0]
+		keys = keys[1:]
+		return key, nil
+	}
+	var played []string
+	s.play = func(item Pron) {
+		played = append(played, item.word+":"+item.author)
+	}
+	return s, &played
+}
+
+func TestSession(t *testing.T) {
+	cfg := make(Config)
+	cfg["VERBOSE"] = "no"
+	cfg["LANG"] = "en"
+	cfg["ATYPE"] = "mp3"
+	cfg["SPEED"] = "1.0"
+	cfg["PRONUNCIATION_CHECK"] = "no"
+	getHTML = getTestURL
+
+	t.Run("Arguments", func(t *testing.T) {
+		source, _ := newWordSource(cfg, []string{"cat", "", "dog"}, nil)
+		keys := []string{"j", "down", "down", "n", "n", "p", "2", "e", "d", "o",
+			"x", "\x7f", "g", "\n", "+", "r", "q", "j"}
+		s, played := scriptedSession(cfg, source, keys)
+		s.run()
+		want := []string{"cat:Author1", "cat:Author2", "cat:Author3",
+			"dog:Author1", "cat:Author1", "cat:Author3", "dog:Author1",
+			"dog:Author1", "dog:Author1"}
+		if !reflect.DeepEqual(*played, want) {
+			t.Errorf("Played %q; expected %q", *played, want)
+		}
+		if !reflect.DeepEqual(s.words, []string{"cat", "dog", "dog"}) {
+			t.Errorf("words == %q; new word should go after the current one", s.words)
+		}
+		if cfg["SPEED"] != "1.1" {
+			t.Errorf("SPEED == %s; expected 1.1", cfg["SPEED"])
+		}
+	})
+
+	t.Run("Keymap", func(t *testing.T) {
+		cfg["KEYMAP"] = "vim"
+		cfg["KEY_NEXT_PRON"] = "1"
+		defer delete(cfg, "KEYMAP")
+		defer delete(cfg, "KEY_NEXT_PRON")
+		source, _ := newWordSource(cfg, []string{"cat", "dog"}, nil)
+		keys := []string{"1", "l", "n", "h", "2", "."}
+		s, played := scriptedSession(cfg, source, keys)
+		s.run()
+		want := []string{"cat:Author1", "cat:Author2", "dog:Author1",
+			"cat:Author1", "cat:Author3", "cat:Author3"}
+		if !reflect.DeepEqual(*played, want) {
+			t.Errorf("Played %q; expected %q", *played, want)
+		}
+	})
+
+	t.Run("Suggestions", func(t *testing.T) {
+		source, _ := newWordSource(cfg, []string{"dgo"}, nil)
+		s, played := scriptedSession(cfg, source, []string{"j", "k", "\n"})
+		s.run()
+		if !reflect.DeepEqual(*played, []string{"dog:Author1"}) ||
+			s.words[0] != "dog" {
+			t.Errorf("Played %q; expected the suggested word", *played)
+		}
+
+		s, _ = scriptedSession(cfg, &argsSource{words: []string{"dgo"}}, nil)
+		s.fetchWord()
+		s.list()
+		s.handle("j")
+		lines := strings.Join(s.render(60, 12), "\n")
+		if !strings.Contains(lines, "Did you mean") ||
+			!strings.Contains(lines, ansiReverse+" ▶ 1  hot dog") {
+			t.Errorf("Suggestions are not shown:\n%s", stripANSI(lines))
+		}
+
+		cfg["KEY_ACCEPT_SUGGESTION"] = "a"
+		defer delete(cfg, "KEY_ACCEPT_SUGGESTION")
+		s, _ = scriptedSession(cfg, &argsSource{words: []string{"dgo"}}, nil)
+		s.fetchWord()
+		s.list()
+		if lines := stripANSI(strings.Join(s.render(60, 12), "\n")); !strings.Contains(lines,
+			"Did you mean (a to choose)") {
+			t.Errorf("Custom key is not shown:\n%s", lines)
+		}
+		for _, key := range []string{"j", "\n", "a"} {
+			s.handle(key)
+		}
+		if s.words[0] != "hot dog" {
+			t.Errorf("words == %q; expected the suggestion chosen with a custom key", s.words)
+		}
+
+		// words from history are suggested too
+		s, _ = scriptedSession(cfg, &argsSource{words: []string{"ambulanse"}}, nil)
+		s.history = []string{"ambulance"}
+		s.fetchWord()
+		s.list()
+		if got := s.suggestions["ambulanse"]; !reflect.DeepEqual(got, []string{"ambulance"}) {
+			t.Errorf("suggestions == %q; expected the word from history", got)
+		}
+	})
+
+	t.Run("SearchPage", func(t *testing.T) {
+		cfg["PRONUNCIATION_CHECK"] = "yes"
+		defer func() { cfg["PRONUNCIATION_CHECK"] = "no" }()
+		var searches int
+		getHTML = func(cfg Config, url string) (string, error) {
+			if strings.Contains(url, "/search/") {
+				searches++
+			}
+			return getTestURL(cfg, url)
+		}
+		defer func() { getHTML = getTestURL }()
+		s, _ := scriptedSession(cfg, &argsSource{words: []string{"tafel"}}, nil)
+		s.run()
+		if searches != 1 {
+			t.Errorf("Search page is fetched %d times; expected once", searches)
+		}
+	})
+
+	t.Run("Library", func(t *testing.T) {
+		dir := t.TempDir()
+		cfg["LIBRARY"] = filepath.Join(dir, "library.json")
+		defer delete(cfg, "LIBRARY")
+		defer func() { userLibrary = nil }()
+		getAudio = downloadTestFile
+
+		keys := []string{"j", "*", "g", "a", " ", "b", "\n", "s", "k", "*", "*"}
+		s, _ := scriptedSession(cfg, &argsSource{words: []string{"cat"}}, keys)
+		list := getPronList(cfg, "cat")
+		for i := range list {
+			list[i].aFile = filepath.Join(dir, "cat.mp3")
+		}
+		s.lists["cat"] = list
+		s.run()
+
+		if _, err := os.Stat(filepath.Join(dir, "cat.mp3")); err != nil {
+			t.Errorf("Pronunciation is not saved: %v", err)
+		}
+		lib, err := loadLibrary(cfg["LIBRARY"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e := lib.entry("en", list[1]); e == nil || !e.Starred ||
+			!reflect.DeepEqual(e.Tags, []string{"a", "b"}) {
+			t.Errorf("Wrong library entry: %+v", e)
+		}
+		if e := lib.entry("en", list[0]); e == nil || e.Starred {
+			t.Errorf("Star should be removed: %+v", e)
+		}
+		s.pronIdx = 1
+		if lines := strings.Join(s.render(80, 12), "\n"); !strings.Contains(lines,
+			"Author2  (male from Unknown)  ★  [a, b]") {
+			t.Errorf("Library marks are not shown:\n%s", stripANSI(lines))
+		}
+	})
+
+	t.Run("Compare", func(t *testing.T) {
+		s, _ := scriptedSession(cfg, &argsSource{words: []string{"cat", "tafel"}},
+			[]string{"c", "n", "c"})
+		var compared []string
+		s.playAll = func(items []Pron) {
+			for _, item := range items {
+				compared = append(compared, item.author+":"+item.country)
+			}
+		}
+		list := getPronList(cfg, "cat")
+		extra := list[0]
+		extra.author = "Author4"
+		s.lists["cat"] = append([]Pron{list[0], list[1], extra}, list[2:]...)
+		s.run()
+
+		want := []string{"Author1:United Kingdom", "Author2:Unknown", "Author3:USA"}
+		if !reflect.DeepEqual(compared, want) {
+			t.Errorf("Compared %q; expected %q", compared, want)
+		}
+
+		s.wordIdx, s.pronIdx = 0, 0
+		s.comparing, s.compareIdx = accentSamples(s.lists["cat"]), 2
+		lines := stripANSI(strings.Join(s.render(100, 12), "\n"))
+		if !strings.Contains(lines, "Accents: United Kingdom → Unknown → [USA]") ||
+			!regexp.MustCompile(` ♪ 3 +Author3`).MatchString(lines) {
+			t.Errorf("Compared accents are not shown:\n%s", lines)
+		}
+		s.compare(s.lists["cat"][:1])
+		if s.status != "All pronunciations are from United Kingdom" {
+			t.Errorf("Wrong status: %q", s.status)
+		}
+	})
+
+	t.Run("File", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "words.txt")
+		os.WriteFile(file, []byte("cat\n\ndog\n"), 0640)
+		cfg["FILE"] = file
+		defer delete(cfg, "FILE")
+		source, err := newWordSource(cfg, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, played := scriptedSession(cfg, source, []string{"\n", "\n", "\n"})
+		s.run()
+		if len(*played) != 2 || !s.eof || s.wordIdx != 1 {
+			t.Errorf("Played %q; expected two words and stop at the last one", *played)
+		}
+		if s.handle("n"); !strings.Contains(s.status, "last word") {
+			t.Errorf("status == %q; expected last word message", s.status)
+		}
+		if err = source.Close(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("Prompt", func(t *testing.T) {
+		keys := []string{"c", "a", "t", "\n", "n", "d", "o", "g", "\n", "n", "\x1b",
+			"p"}
+		s, played := scriptedSession(cfg, nil, keys)
+		s.source, _ = newWordSource(cfg, nil, s.prompt)
+		s.run()
+		want := []string{"cat:Author1", "dog:Author1", "cat:Author1"}
+		if !reflect.DeepEqual(*played, want) {
+			t.Errorf("Played %q; expected %q", *played, want)
+		}
+		if s.eof {
+			t.Errorf("Canceled prompt should not end the source")
+		}
+
+		cfg["HISTORY"] = filepath.Join(t.TempDir(), "history.jsonl")
+		defer delete(cfg, "HISTORY")
+		addHistory(cfg, "dog", Pron{})
+		addHistory(cfg, "test", Pron{})
+		keys = []string{"up", "up", "\n", "j", "e", "t", "\t", "\t", "\t", "\n"}
+		s, played = scriptedSession(cfg, nil, keys)
+		s.source, _ = newWordSource(cfg, nil, s.prompt)
+		s.run()
+		want = []string{"dog:Author1", "dog:Author2", "test:Author1"}
+		if !reflect.DeepEqual(*played, want) {
+			t.Errorf("Played %q; expected %q", *played, want)
+		}
+		entries, _ := readHistory(cfg["HISTORY"])
+		if len(entries) != 4 || entries[2].Author != "Author2" || entries[3].Word != "test" {
+			t.Errorf("Words are not recorded in history: %+v", entries)
+		}
+
+		s, played = scriptedSession(cfg, nil, []string{"\x1b"})
+		s.source, _ = newWordSource(cfg, nil, s.prompt)
+		s.run()
+		if len(*played) != 0 {
+			t.Errorf("Session without words should end")
+		}
+	})
+
+	t.Run("Redraw", func(t *testing.T) {
+		s, _ := scriptedSession(cfg, nil, nil)
+		// the key comes only after the screen is drawn
+		out := &drawnWriter{drawn: make(chan struct{})}
+		s.out = out
+		s.readKey = func() (string, error) {
+			<-out.drawn
+			return "x", nil
+		}
+		go func() {
+			s.setStatus("playback failed")
+			s.requestRedraw()
+		}()
+		if key, _ := s.nextKey(); key != "x" {
+			t.Errorf("Got key %q; expected %q", key, "x")
+		}
+		if !strings.Contains(out.String(), "playback failed") {
+			t.Errorf("Screen is not redrawn while waiting for a key")
+		}
+	})
+
+	t.Run("ReadError", func(t *testing.T) {
+		source, _ := newWordSource(cfg, []string{"cat", "dog"}, nil)
+		s, played := scriptedSession(cfg, source, nil)
+		s.readKey = func() (string, error) { return "", io.EOF }
+		s.run()
+		if len(*played) != 1 || s.err != io.EOF {
+			t.Errorf("Session should end when keys can not be read: %q, %v",
+				*played, s.err)
+		}
+		if !reflect.DeepEqual(s.words, []string{"cat"}) {
+			t.Errorf("words == %q; words should be taken when they are needed", s.words)
+		}
+	})
+
+	t.Run("Recent", func(t *testing.T) {
+		cfg["HISTORY"] = filepath.Join(t.TempDir(), "history.jsonl")
+		cfg["RECENT"] = "yes"
+		defer delete(cfg, "HISTORY")
+		defer delete(cfg, "RECENT")
+		if _, err := newWordSource(cfg, nil, nil); err == nil {
+			t.Errorf("Empty history should not be a source of words")
+		}
+		addHistory(cfg, "cat", Pron{})
+		addHistory(cfg, "dog", Pron{})
+		addHistory(cfg, "cat", Pron{})
+		source, err := newWordSource(cfg, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, played := scriptedSession(cfg, source, []string{"n", "n"})
+		s.run()
+		want := []string{"cat:Author1", "dog:Author1"}
+		if !reflect.DeepEqual(*played, want) {
+			t.Errorf("Played %q; expected %q", *played, want)
+		}
+	})
+}
+
+// drawnWriter is a screen which tells when it is drawn first time
+type drawnWriter struct {
+	bytes.Buffer
+	drawn chan struct{}
+}
+
+func (w *drawnWriter) Write(p []byte) (int, error) {
+	if w.Len() == 0 {
+		defer close(w.drawn)
+	}
+	return w.Buffer.Write(p)
+}
@@ -7,9 +7,7 @@ import (
 	"io"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"runtime"
 	"strings"
 	"time"
 
@@ -22,60 +20,69 @@ const downloadRepeats = 10
 const downloadTimeout = 5 * time.Second
 const testFiles = "local_files"
 
-// sayWord tries to play audiofile with pronunciation using mpg123 cmd-line app
-func sayWord(path string) {
-	mpg123 := exec.Command("mpg123", "-q", path)
-	if err := mpg123.Run(); err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
-	}
-}
-
-// clearScreenInit prepare platform independent function for terminal clearing
-func clearScreen() {
-	switch runtime.GOOS {
-	case "linux":
-		cmd := exec.Command("clear")
-		cmd.Stdout = os.Stdout
-		cmd.Run()
-	case "darwin":
-		cmd := exec.Command("clear")
-		cmd.Stdout = os.Stdout
-		cmd.Run()
-	case "windows":
-		cmd := exec.Command("cmd", "/c", "cls")
-		cmd.Stdout = os.Stdout
-		cmd.Run()
-	}
-}
+// stdinReader is shared by all keyboard reads, so bytes of escape sequences
+// are not lost between calls
+var stdinReader = bufio.NewReader(os.Stdin)
 
-// getChar reads from STDIN one character
-func getChar() string {
-	state, err := term.MakeRaw(0)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
-	}
-	defer func() {
-		err := term.Restore(0, state)
+// getChar reads from STDIN one character. Keys sending escape sequences are
+// returned by names like "up", "f5" or "ctrl-left", Esc followed by a
+// character as "alt-" and the character. Returns io.EOF if the input is
+// closed.
+func getChar() (key string, err error) {
+	if term.IsTerminal(0) {
+		state, err := term.MakeRaw(0)
 		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
-			os.Exit(1)
+			return "", err
 		}
-	}()
+		defer func() {
+			if rerr := term.Restore(0, state); err == nil {
+				err = rerr
+			}
+		}()
+	}
 
-	in := bufio.NewReader(os.Stdin)
-	char, _, err := in.ReadRune()
+	char, _, err := stdinReader.ReadRune()
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		return "", err
 	}
 
 	if char == '\r' {
 		char = '\n'
 	}
+	// a terminal sends the whole escape sequence at once, so a lone Esc
+	// has nothing buffered after it
+	if char == '\x1b' && stdinReader.Buffered() > 0 {
+		return readEscape(), nil
+	}
 
-	return string(char)
+	return string(char), nil
+}
+
+// readEscape reads the rest of escape sequence after Esc and returns name of
+// the key or empty string for unknown sequences
+func readEscape() string {
+	var seq []byte
+	for stdinReader.Buffered() > 0 {
+		if len(seq) == 0 {
+			r, _, _ := stdinReader.ReadRune()
+			if r != '[' && r != 'O' {
+				return "alt-" + keyName(string(r))
+			}
+			seq = append(seq, byte(r))
+			continue
+		}
+		b, _ := stdinReader.ReadByte()
+		seq = append(seq, b)
+		// sequences end with a letter or ~ after [ or O prefix
+		if b >= 0x40 && b <= 0x7e {
+			break
+		}
+	}
+	name, err := parseEscape(string(seq))
+	if err != nil {
+		return ""
+	}
+	return name
 }
 
 // getURL gets a web page, handles possible errors and returns the web page
@@ -93,6 +100,9 @@ func getURL(cfg Config, url string) (string, error) {
 		resp, err = http.Get(url)
 		repeat--
 	}
+	if err != nil {
+		return "", err
+	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
@@ -101,8 +111,7 @@ func getURL(cfg Config, url string) (string, error) {
 
 	bytes, err := io.ReadAll(resp.Body)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		return "", err
 	}
 	return string(bytes), nil
 }
@@ -149,14 +158,12 @@ func downloadFile(cfg Config, url, dst string) error {
 	dir := filepath.Dir(dst)
 	err := os.MkdirAll(dir, 0750)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		return err
 	}
 
 	f, err := os.Create(dst)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		return err
 	}
 	defer f.Close()
 
@@ -169,6 +176,9 @@ func downloadFile(cfg Config, url, dst string) error {
 		resp, err = http.Get(url)
 		repeat--
 	}
+	if err != nil {
+		return err
+	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
@@ -176,12 +186,7 @@ func downloadFile(cfg Config, url, dst string) error {
 	}
 
 	_, err = io.Copy(f, resp.Body)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
-	}
-
-	return nil
+	return err
 }
 
 // downloadTestFile can be used in tests and download audio file from file system
@@ -190,42 +195,76 @@ func downloadTestFile(cfg Config, url, dst string) error {
 		fmt.Printf("Download test file: `%s`\n", url)
 	}
 	dir := filepath.Dir(dst)
-	err := os.MkdirAll(dir, 0750)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return err
 	}
 
-	first := strings.LastIndex(url, "/")
-	src := filepath.Join(testFiles, "forvo_"+cfg["LANG"]+"_"+url[first+1:])
-
-	copyFile(cfg, src, dst)
+	// pronunciations of a test word share its audio file: cat_2.mp3 is
+	// forvo_en_cat.mp3
+	name := url[strings.LastIndex(url, "/")+1:]
+	ext := filepath.Ext(name)
+	if i := strings.LastIndex(name, "_"); i > -1 {
+		name = name[:i] + ext
+	}
+	src := filepath.Join(testFiles, "forvo_"+cfg["LANG"]+"_"+name)
 
-	return nil
+	return copyFile(cfg, src, dst)
 }
 
 // copyFile just a helper function to copy file in a more comfortable way
-func copyFile(cfg Config, src, dst string) {
+func copyFile(cfg Config, src, dst string) error {
 	if cfg["VERBOSE"] == "yes" {
 		fmt.Printf("Copy file: `%s`\n", src)
 	}
 	in, err := os.Open(src)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		return err
 	}
 	defer in.Close()
 
 	out, err := os.Create(dst)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
 	}
-	defer out.Close()
+	return out.Close()
+}
 
-	_, err = io.Copy(out, in)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+// splitCommand splits command line into arguments. Arguments can be quoted
+// with single or double quotes to keep spaces inside them.
+func splitCommand(line string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	var quote rune
+	inArg := false
+	for _, r := range line {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			arg.WriteRune(r)
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, errors.New("unclosed quote in command: " + line)
+	}
+	if inArg {
+		args = append(args, arg.String())
 	}
+	return args, nil
 }
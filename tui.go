@@ -0,0 +1,363 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/term"
+)
+
+const (
+	ansiReverse = "\x1b[7m"
+	ansiBold    = "\x1b[1m"
+	ansiReset   = "\x1b[0m"
+)
+
+const tuiMinWidth, tuiMinHeight = 40, 8
+
+// runTUI runs the full-screen interactive mode: a word list on the left,
+// pronunciations of the current word on the right and a status bar
+func runTUI(cfg Config, args []string) {
+	s, err := newSession(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	source, err := newWordSource(cfg, args, s.prompt)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	s.source = source
+
+	if err = s.fullScreen(s.run); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err = source.Close(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// fullScreen switches the terminal to raw mode and the alternate screen for
+// the time of run. Playback errors are shown in the status bar. Returns
+// error if the terminal can not be switched or keys can not be read.
+func (s *session) fullScreen(run func()) error {
+	fd := int(os.Stdin.Fd())
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return err
+	}
+	defer term.Restore(fd, state)
+	// alternate screen keeps the terminal content we had before
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	defer fmt.Print("\x1b[?25h\x1b[?1049l")
+	defer func(report func(err error)) { playbackError = report }(playbackError)
+	playbackError = func(err error) {
+		s.setStatus(err.Error())
+		s.requestRedraw()
+	}
+	run()
+	// closed input just ends the session
+	if s.err == io.EOF {
+		return nil
+	}
+	return s.err
+}
+
+// draw renders the interface to the terminal
+func (s *session) draw() {
+	width, height := s.width, s.height
+	if width == 0 || height == 0 {
+		var err error
+		width, height, err = term.GetSize(int(os.Stdout.Fd()))
+		if err != nil || width <= 0 || height <= 0 {
+			width, height = 80, 24
+		}
+	}
+	s.mu.Lock()
+	lines := s.screen(width, height)
+	s.mu.Unlock()
+
+	var b strings.Builder
+	b.WriteString("\x1b[H")
+	for i, line := range lines {
+		b.WriteString(line)
+		b.WriteString("\x1b[K")
+		if i < len(lines)-1 {
+			b.WriteString("\r\n")
+		}
+	}
+	fmt.Fprint(s.out, b.String())
+}
+
+// render returns screen lines of the interface for a terminal of the given
+// size
+func (s *session) render(width, height int) []string {
+	if width < tuiMinWidth {
+		width = tuiMinWidth
+	}
+	if height < tuiMinHeight {
+		height = tuiMinHeight
+	}
+	rows := height - 3
+
+	// word list pane
+	paneWidth := 12
+	for _, word := range s.words {
+		if n := utf8.RuneCountInString(word) + 3; n > paneWidth {
+			paneWidth = n
+		}
+	}
+	if paneWidth > width/3 {
+		paneWidth = width / 3
+	}
+	left := make([]string, rows)
+	first := scrollOffset(s.wordIdx, len(s.words), rows)
+	for i := range left {
+		idx := first + i
+		if idx >= len(s.words) {
+			left[i] = strings.Repeat(" ", paneWidth)
+			continue
+		}
+		left[i] = fit(" "+s.words[idx], paneWidth)
+		if idx == s.wordIdx {
+			left[i] = ansiReverse + left[i] + ansiReset
+		}
+	}
+
+	// pronunciations pane
+	right := s.pronLines(rows, width-paneWidth-2)
+
+	lines := []string{ansiReverse + fit(fmt.Sprintf(" tellme-go  [%s]",
+		s.cfg["LANG"]), width) + ansiReset}
+	for i := 0; i < rows; i++ {
+		lines = append(lines, left[i]+" │"+right[i])
+	}
+
+	status := fmt.Sprintf(" word %d/%d", s.wordIdx+1, len(s.words))
+	if len(s.words) == 0 {
+		status = " no words"
+	} else if !s.eof {
+		// the source can give more words
+		status += "+"
+	}
+	if list := s.lists[s.currentWord()]; len(list) > 0 {
+		status += fmt.Sprintf("  pronunciation %d/%d", s.pronIdx+1, len(list))
+	}
+	status += fmt.Sprintf("  speed %.1fx", playbackSpeed(s.cfg))
+	if accents := s.accentsLine(); accents != "" {
+		status += "  │ " + accents
+	}
+	if s.status != "" || s.editor != nil {
+		status += "  │ " + s.status
+	}
+	if s.editor != nil {
+		lines = append(lines, editorBar(status, s.editor, width))
+	} else {
+		lines = append(lines, ansiReverse+fit(status, width)+ansiReset)
+	}
+	lines = append(lines, fit(s.keymap.helpLine(), width))
+	return lines
+}
+
+// editorBar returns the status bar with edited text and a cursor. Long text
+// is scrolled to keep the cursor visible.
+func editorBar(status string, ed *lineEditor, width int) string {
+	runes := []rune(status + ed.String() + " ")
+	col := utf8.RuneCountInString(status) + ed.pos
+	if col >= width {
+		runes = runes[col-width+1:]
+		col = width - 1
+	}
+	bar := []rune(fit(string(runes), width))
+	// combining marks stay with the character under cursor
+	end := col + 1
+	for end < len(bar) && unicode.Is(unicode.Mn, bar[end]) {
+		end++
+	}
+	return ansiReverse + string(bar[:col]) + ansiReset + string(bar[col:end]) +
+		ansiReverse + string(bar[end:]) + ansiReset
+}
+
+// pronLines returns lines of the pronunciations pane
+func (s *session) pronLines(rows, width int) []string {
+	word := s.currentWord()
+	if word == "" {
+		lines := make([]string, rows)
+		for i := range lines {
+			lines[i] = strings.Repeat(" ", width)
+		}
+		return lines
+	}
+	lines := []string{
+		" " + ansiBold + fit(word, width-1) + ansiReset,
+		" " + fit(strings.Repeat("=", utf8.RuneCountInString(word)), width-1),
+		strings.Repeat(" ", width),
+	}
+
+	list, loaded := s.lists[word]
+	if !loaded {
+		lines = append(lines, fit(" Loading...", width))
+	} else if len(list) == 0 {
+		lines = append(lines, fit(" No pronunciations. Press "+
+			s.keymap.label("retry")+" to try again", width))
+		if suggestions := s.suggestions[word]; len(suggestions) > 0 {
+			lines = append(lines, s.suggestionLines(suggestions, rows-len(lines), width)...)
+		}
+	}
+
+	digitsNum := len(strconv.Itoa(len(list) - 1))
+	listRows := rows - len(lines)
+	first := scrollOffset(s.pronIdx, len(list), listRows)
+	for i := first; i < len(list) && i < first+listRows; i++ {
+		item := list[i]
+		text := fmt.Sprintf("%0*d  %s  %s  (%s from %s)%s%s", digitsNum, i,
+			s.clipColumn(item), item.author, item.sex, item.country,
+			s.problemMark(item), s.libraryMarks(item))
+		line := fit("   "+text, width)
+		if s.isComparing(item) {
+			line = fit(" ♪ "+text, width)
+		}
+		if i == s.pronIdx {
+			line = ansiReverse + fit(" ▶ "+text, width) + ansiReset
+		}
+		lines = append(lines, line)
+	}
+	for len(lines) < rows {
+		lines = append(lines, strings.Repeat(" ", width))
+	}
+	return lines[:rows]
+}
+
+// accentsLine returns countries of compared pronunciations with the playing
+// one in brackets
+func (s *session) accentsLine() string {
+	if len(s.comparing) == 0 || s.comparing[0].word != s.currentWord() {
+		return ""
+	}
+	var countries []string
+	for i, item := range s.comparing {
+		if i == s.compareIdx {
+			countries = append(countries, "["+item.country+"]")
+		} else {
+			countries = append(countries, item.country)
+		}
+	}
+	return "Accents: " + strings.Join(countries, " → ")
+}
+
+// isComparing checks if a pronunciation is playing to compare accents
+func (s *session) isComparing(item Pron) bool {
+	if len(s.comparing) == 0 {
+		return false
+	}
+	return s.comparing[s.compareIdx].id == item.id
+}
+
+// clipColumn returns duration and waveform of a pronunciation if its audio
+// is downloaded, otherwise blanks of the same width
+func (s *session) clipColumn(item Pron) string {
+	info := s.clip(item)
+	if info == nil {
+		return strings.Repeat(" ", sparkWidth+6)
+	}
+	return fmt.Sprintf("%4.1fs %s", info.duration.Seconds(), info.wave)
+}
+
+// clip returns information about downloaded audio of a pronunciation or nil
+// if it is not downloaded or can not be decoded
+func (s *session) clip(item Pron) *clipInfo {
+	path := downloadedAudio(item)
+	if path == "" {
+		return nil
+	}
+	info, ok := s.clips[path]
+	if !ok {
+		// audio files do not change, so every file is decoded once
+		info, _ = loadClipInfo(path)
+		s.clips[path] = info
+	}
+	return info
+}
+
+// problemMark returns a warning about a broken recording
+func (s *session) problemMark(item Pron) string {
+	if s.cfg["QUALITY_CHECK"] != "yes" {
+		return ""
+	}
+	if info := s.clip(item); info != nil && info.problem != "" {
+		return "  ⚠ " + info.problem
+	}
+	return ""
+}
+
+// libraryMarks returns a star and tags of a pronunciation from the library
+func (s *session) libraryMarks(item Pron) string {
+	e := s.library.entry(s.cfg["LANG"], item)
+	if e == nil {
+		return ""
+	}
+	var marks string
+	if e.Starred {
+		marks += "  ★"
+	}
+	if len(e.Tags) > 0 {
+		marks += "  [" + strings.Join(e.Tags, ", ") + "]"
+	}
+	return marks
+}
+
+// suggestionLines returns lines with words similar to the current word
+func (s *session) suggestionLines(suggestions []string, rows, width int) []string {
+	lines := []string{
+		strings.Repeat(" ", width),
+		fit(" Did you mean ("+s.keymap.label("accept_suggestion")+" to choose):", width),
+	}
+	listRows := rows - len(lines)
+	first := scrollOffset(s.pronIdx, len(suggestions), listRows)
+	for i := first; i < len(suggestions) && i < first+listRows; i++ {
+		if i == s.pronIdx {
+			lines = append(lines, ansiReverse+fit(fmt.Sprintf(" ▶ %d  %s", i,
+				suggestions[i]), width)+ansiReset)
+		} else {
+			lines = append(lines, fit(fmt.Sprintf("   %d  %s", i, suggestions[i]), width))
+		}
+	}
+	return lines
+}
+
+// scrollOffset returns the first visible item of a list with rows visible
+// lines keeping the current item in sight
+func scrollOffset(current, total, rows int) int {
+	if rows <= 0 || total <= rows {
+		return 0
+	}
+	first := current - rows/2
+	if first < 0 {
+		first = 0
+	}
+	if first > total-rows {
+		first = total - rows
+	}
+	return first
+}
+
+// fit cuts or pads string with spaces to width runes
+func fit(s string, width int) string {
+	if width <= 0 {
+		return ""
+	}
+	n := utf8.RuneCountInString(s)
+	if n > width {
+		runes := []rune(s)
+		return string(runes[:width-1]) + "…"
+	}
+	return s + strings.Repeat(" ", width-n)
+}
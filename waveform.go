@@ -0,0 +1,70 @@
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// sparkBlocks are levels of waveform sparklines from silence to full scale
+var sparkBlocks = []rune(" ▁▂▃▄▅▆▇█")
+
+// sparkWidth is number of blocks in a waveform sparkline
+const sparkWidth = 8
+
+// clipInfo is duration, waveform and problem of a pronunciation
+type clipInfo struct {
+	duration time.Duration
+	wave     string
+	problem  string
+}
+
+// loadClipInfo decodes audio file to get its duration, waveform and problem
+func loadClipInfo(path string) (*clipInfo, error) {
+	audio, err := decodeAudio(path)
+	if err != nil {
+		return nil, err
+	}
+	return &clipInfo{
+		duration: audio.duration(),
+		wave:     audio.sparkline(sparkWidth),
+		problem:  audio.problem(),
+	}, nil
+}
+
+// sparkline returns peaks of audio as a line of width blocks. Levels are
+// not scaled, so quiet recordings look flat and clipped ones hit the top.
+func (p *pcm) sparkline(width int) string {
+	blocks := make([]rune, width)
+	frames := p.frames()
+	for i := range blocks {
+		start, end := i*frames/width, (i+1)*frames/width
+		var peak float64
+		for _, v := range p.samples[start*p.channels : end*p.channels] {
+			peak = math.Max(peak, math.Abs(float64(v)))
+		}
+		level := int(math.Round(peak * float64(len(sparkBlocks)-1)))
+		if level > len(sparkBlocks)-1 {
+			level = len(sparkBlocks) - 1
+		}
+		blocks[i] = sparkBlocks[level]
+	}
+	return string(blocks)
+}
+
+// downloadedAudio returns path of already downloaded audio of a pronunciation
+// in the cache or in the temporary directory. Returns empty string if audio
+// has not been downloaded yet.
+func downloadedAudio(item Pron) string {
+	paths := []string{item.cacheFile}
+	if tmpDir != "" {
+		paths = append(paths, filepath.Join(tmpDir, filepath.Base(item.cacheFile)))
+	}
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+			return path
+		}
+	}
+	return ""
+}